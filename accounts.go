@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"strings"
+)
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// streamTypes is set by the -stream-types flag. When it is non-empty, only
+// URLs of these stream types are collected.
+var streamTypes []string
+
+// wantStreamType reports whether URLs of streamType are collected this run.
+func wantStreamType(streamType string) bool {
+	return len(streamTypes) == 0 || slices.Contains(streamTypes, streamType)
+}
+
+// warnUnknownStreamTypes logs each of streamTypes that no URL of accounts
+// has, which is most likely a typo.
+func warnUnknownStreamTypes(accounts []Account) {
+	for _, t := range streamTypes {
+		found := slices.ContainsFunc(accounts, func(a Account) bool {
+			return slices.ContainsFunc(a.streamURLs(), func(u StreamURL) bool { return u.StreamType == t })
+		})
+		if !found {
+			slog.Warn("No URL with this stream type in config", "stream_type", t)
+		}
+	}
+}
+
+// shuffleAccounts returns a copy of accounts in random order, each with its
+// URLs (inline and from its URLsFile) shuffled too. A non-zero seed gives
+// the same order every time.
+func shuffleAccounts(accounts []Account, seed int64) []Account {
+	r := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+	if seed != 0 {
+		r = rand.New(rand.NewPCG(uint64(seed), 0))
+	}
+
+	out := slices.Clone(accounts)
+	r.Shuffle(len(out), func(i, j int) { out[i], out[j] = out[j], out[i] })
+	for i := range out {
+		urls := out[i].streamURLs()
+		r.Shuffle(len(urls), func(i, j int) { urls[i], urls[j] = urls[j], urls[i] })
+		out[i].URLs, out[i].fileURLs = urls, nil
+	}
+	return out
+}
+
+// filterAccounts keeps accounts named in include (all of them when include
+// is empty) and drops those named in exclude. Names that match no account
+// are logged and otherwise ignored.
+func filterAccounts(accounts []Account, include, exclude []string) []Account {
+	for _, name := range slices.Concat(include, exclude) {
+		if !slices.ContainsFunc(accounts, func(a Account) bool { return a.Name == name }) {
+			slog.Warn("No account with this name in config", "account", name)
+		}
+	}
+
+	var out []Account
+	for _, a := range accounts {
+		if len(include) > 0 && !slices.Contains(include, a.Name) {
+			continue
+		}
+		if slices.Contains(exclude, a.Name) {
+			continue
+		}
+		out = append(out, a)
+	}
+	return out
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/network"
+)
+
+// Cookie is a cookie set in the browser before an account's pages load.
+type Cookie struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	// Domain scopes the cookie to a host and, with a leading dot, its
+	// subdomains. Empty scopes it to the host of the URL being collected.
+	Domain   string `json:"domain"`
+	Path     string `json:"path"`
+	Secure   bool   `json:"secure"`
+	HTTPOnly bool   `json:"httpOnly"`
+	// Expires is a Unix time in seconds. Zero makes a session cookie.
+	Expires int64 `json:"expires"`
+}
+
+// loadCookiesFiles reads the CookiesFile of every account.
+func loadCookiesFiles(accounts []Account) error {
+	for i := range accounts {
+		a := &accounts[i]
+		if a.CookiesFile == "" {
+			continue
+		}
+
+		f, err := os.Open(a.CookiesFile)
+		if err != nil {
+			return err
+		}
+		cookies, err := parseCookiesFile(a.CookiesFile, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		a.fileCookies = cookies
+	}
+	return nil
+}
+
+// parseCookiesFile reads a Netscape (curl, wget, browser extension export)
+// cookie file: domain, include-subdomains flag, path, secure flag, expiry,
+// name and value, separated by tabs. Lines prefixed with #HttpOnly_ are
+// HTTP-only cookies; other # lines are comments.
+func parseCookiesFile(name string, r io.Reader) ([]Cookie, error) {
+	var cookies []Cookie
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		httpOnly := false
+		if rest, ok := strings.CutPrefix(line, "#HttpOnly_"); ok {
+			line, httpOnly = rest, true
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("%s:%d: expected 7 tab-separated fields, got %d", name, n, len(fields))
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid expiry %q", name, n, fields[4])
+		}
+
+		// Netscape files mark domain cookies with the flag rather than a
+		// leading dot, which is what Chrome expects.
+		domain := strings.TrimPrefix(fields[0], ".")
+		if strings.EqualFold(fields[1], "TRUE") {
+			domain = "." + domain
+		}
+
+		cookies = append(cookies, Cookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Domain:   domain,
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			HTTPOnly: httpOnly,
+			Expires:  expires,
+		})
+	}
+	return cookies, scanner.Err()
+}
+
+// cookieParams converts the account's cookies into browser cookies for
+// pageURL, skipping any that have already expired.
+func (a Account) cookieParams(pageURL string) []*network.CookieParam {
+	now := time.Now()
+
+	var params []*network.CookieParam
+	for _, c := range slices.Concat(a.Cookies, a.fileCookies) {
+		if c.Expires > 0 && time.Unix(c.Expires, 0).Before(now) {
+			continue
+		}
+
+		p := &network.CookieParam{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Secure:   c.Secure,
+			HTTPOnly: c.HTTPOnly,
+		}
+		if p.Path == "" {
+			p.Path = "/"
+		}
+		switch {
+		case strings.HasPrefix(c.Domain, "."):
+			p.Domain = c.Domain
+		case c.Domain != "":
+			// Without a leading dot the cookie is host-only, which Chrome
+			// only allows when it is set through a URL.
+			scheme := "http"
+			if c.Secure {
+				scheme = "https"
+			}
+			p.URL = (&url.URL{Scheme: scheme, Host: c.Domain, Path: p.Path}).String()
+		default:
+			p.URL = pageURL
+		}
+		if c.Expires > 0 {
+			expires := cdp.TimeSinceEpoch(time.Unix(c.Expires, 0))
+			p.Expires = &expires
+		}
+		params = append(params, p)
+	}
+	return params
+}
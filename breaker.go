@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned without calling a provider whose circuit
+// breaker is open.
+var errCircuitOpen = errors.New("provider circuit open after repeated failures")
+
+// Circuit breaker states, also the value of the
+// cdnshare_provider_circuit_state gauge.
+const (
+	circuitClosed   = 0
+	circuitOpen     = 1
+	circuitHalfOpen = 2
+)
+
+// circuitBreaker fails fast for a provider that keeps failing. After
+// threshold consecutive failures it opens for cooldown; then it lets one
+// probe through (half-open) and closes again if the probe succeeds.
+type circuitBreaker struct {
+	provider  string
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+}
+
+// breakers holds one circuit breaker per provider, created on first use.
+var breakers sync.Map
+
+// providerBreaker returns the breaker for provider, configured from
+// lookup.circuitBreaker.
+func providerBreaker(provider string) *circuitBreaker {
+	b, _ := breakers.LoadOrStore(provider, &circuitBreaker{
+		provider:  provider,
+		threshold: config.Lookup.CircuitBreaker.FailureThreshold,
+		cooldown:  time.Duration(config.Lookup.CircuitBreaker.CooldownSeconds) * time.Second,
+	})
+	return b.(*circuitBreaker)
+}
+
+// allow reports whether a call may go ahead. While half-open, only the
+// single probe call is allowed.
+func (b *circuitBreaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(circuitHalfOpen)
+		return true
+	case circuitHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+// record updates the breaker with the outcome of an allowed call.
+func (b *circuitBreaker) record(err error) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		if b.state != circuitClosed {
+			slog.Info("Provider recovered, closing circuit", "provider", b.provider)
+		}
+		b.failures = 0
+		b.setState(circuitClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.threshold {
+		if b.state != circuitOpen {
+			slog.Warn("Provider failing, opening circuit", "provider", b.provider, "failures", b.failures, "cooldown", b.cooldown)
+		}
+		b.openedAt = time.Now()
+		b.setState(circuitOpen)
+	}
+}
+
+// abandon gives back a call allowed by allow that was not made, so a
+// half-open breaker probes again on the next call.
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == circuitHalfOpen {
+		b.setState(circuitOpen)
+	}
+}
+
+func (b *circuitBreaker) setState(state int) {
+	b.state = state
+	providerCircuitState.WithLabelValues(b.provider).Set(float64(state))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/chromedp/chromedp"
+)
+
+// browserSlots caps the number of browser tabs open at once across all
+// accounts. It is nil, and tabs are unlimited, when maxBrowsers is unset.
+var browserSlots chan struct{}
+
+func newBrowserSlots(n int) chan struct{} {
+	if n <= 0 {
+		return nil
+	}
+	return make(chan struct{}, n)
+}
+
+// acquireBrowser waits for a free browser slot. It fails only if ctx ends
+// first.
+func acquireBrowser(ctx context.Context) error {
+	if browserSlots == nil {
+		return nil
+	}
+	select {
+	case browserSlots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// releaseBrowser frees a slot taken by acquireBrowser.
+func releaseBrowser() {
+	if browserSlots != nil {
+		<-browserSlots
+	}
+}
+
+// connectRemoteBrowser returns a context whose tabs open on the Chrome at
+// remoteURL, a DevTools endpoint such as "http://chrome:9222" or
+// "ws://chrome:9222/devtools/browser/<id>". It opens and closes one tab
+// first so an unreachable browser is reported once, up front, rather than
+// as a navigation failure for every URL.
+func connectRemoteBrowser(ctx context.Context, remoteURL string) (context.Context, context.CancelFunc, error) {
+	allocCtx, cancel := chromedp.NewRemoteAllocator(ctx, remoteURL)
+
+	tabCtx, cancelTab := chromedp.NewContext(allocCtx)
+	defer cancelTab()
+	if err := chromedp.Run(tabCtx); err != nil {
+		cancel()
+		return nil, nil, fmt.Errorf("error connecting to remote browser %s: %w", remoteURL, err)
+	}
+	return allocCtx, cancel, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"sync/atomic"
+)
+
+// errBudgetExceeded is returned for cache misses once the run has used up
+// lookup.maxLookups.
+var errBudgetExceeded = errors.New("lookup budget exhausted, cache only")
+
+// lookups counts the provider calls made by the current run.
+var lookups = newLookupBudget(0)
+
+// lookupBudget caps the number of provider calls (ipinfo, whois, RDAP and
+// Team Cymru) a run may make. A max of zero means unlimited.
+type lookupBudget struct {
+	max    int64
+	used   atomic.Int64
+	warned atomic.Bool
+}
+
+func newLookupBudget(max int) *lookupBudget {
+	return &lookupBudget{max: int64(max)}
+}
+
+// take reserves one provider call and reports whether the budget allowed
+// it. The first refusal is logged.
+func (b *lookupBudget) take() bool {
+	n := b.used.Add(1)
+	if b.max <= 0 || n <= b.max {
+		stats.lookup()
+		return true
+	}
+
+	b.used.Add(-1)
+	stats.lookupOverBudget()
+	if b.warned.CompareAndSwap(false, true) {
+		slog.Warn("Lookup budget reached, using cached results only for the rest of the run", "max_lookups", b.max)
+	}
+	return false
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultCacheFile = "whois_cache.gob"
+
+// cacheFlag is the -cache flag, which names the cache file outright.
+var cacheFlag string
+
+var cacheNamespacePattern = regexp.MustCompile(`^[A-Za-z0-9_-]*$`)
+
+// cachePath returns the cache file to use: -cache, or else cache.file with
+// cache.namespace added before its extension.
+func cachePath() string {
+	if cacheFlag != "" {
+		return cacheFlag
+	}
+
+	path := cmp.Or(config.Cache.File, defaultCacheFile)
+	if ns := config.Cache.Namespace; ns != "" {
+		ext := filepath.Ext(path)
+		path = strings.TrimSuffix(path, ext) + "." + ns + ext
+	}
+	return path
+}
+
+// encryptedCacheMagic prefixes cache files written with an encryption key.
+var encryptedCacheMagic = []byte("CDNSENC1")
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// cacheKey returns the AES-256 key for the cache file, or nil when the cache
+// is not encrypted.
+func cacheKey() []byte {
+	passphrase := config.Cache.EncryptionKey
+	if env := os.Getenv("CDNSHARE_CACHE_KEY"); env != "" {
+		passphrase = env
+	}
+	if passphrase == "" {
+		return nil
+	}
+
+	key := sha256.Sum256([]byte(passphrase))
+	return key[:]
+}
+
+// loadCache reads the WHOIS cache file. It accepts encrypted, gzipped and
+// plain files, in gob or JSON format. An encrypted file that can't be
+// decrypted is treated as an empty cache.
+func loadCache() error {
+	cacheData, err := os.ReadFile(cacheFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// If the cache file does not exist yet, that's fine
+			return nil
+		}
+		return err
+	}
+
+	if bytes.HasPrefix(cacheData, encryptedCacheMagic) {
+		cacheData, err = decryptCache(cacheData[len(encryptedCacheMagic):], cacheKey())
+		if err != nil {
+			slog.Warn("Could not decrypt cache, starting with an empty cache", "path", cacheFile, "error", err)
+			return nil
+		}
+	}
+
+	if bytes.HasPrefix(cacheData, gzipMagic) {
+		gz, err := gzip.NewReader(bytes.NewReader(cacheData))
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+
+		cacheData, err = io.ReadAll(gz)
+		if err != nil {
+			return err
+		}
+	}
+
+	entries, err := decodeCacheEntries(cacheData)
+	if err != nil {
+		return err
+	}
+
+	whoisCache.load(entries)
+	compactCache()
+	return nil
+}
+
+// compactCache drops the entries older than cache.maxAgeDays and logs how
+// many there were.
+func compactCache() {
+	if config.Cache.MaxAgeDays <= 0 {
+		return
+	}
+
+	maxAge := time.Duration(config.Cache.MaxAgeDays) * 24 * time.Hour
+	if removed := whoisCache.removeOlderThan(time.Now().Add(-maxAge)); removed > 0 {
+		slog.Info("Compacted cache", "path", cacheFile, "removed", removed, "max_age", maxAge)
+	}
+}
+
+// decodeCacheEntries decodes data in the format set in config.Cache.Format,
+// falling back to the other format so that switching formats keeps the
+// existing cache.
+func decodeCacheEntries(data []byte) (map[string]WhoisCacheData, error) {
+	decoders := []func([]byte, *map[string]WhoisCacheData) error{decodeGobCache, decodeJSONCache}
+	if config.Cache.Format == "json" {
+		slices.Reverse(decoders)
+	}
+
+	var firstErr error
+	for _, decode := range decoders {
+		entries := make(map[string]WhoisCacheData)
+		err := decode(data, &entries)
+		if err == nil {
+			return entries, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+func decodeGobCache(data []byte, entries *map[string]WhoisCacheData) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(entries)
+}
+
+func decodeJSONCache(data []byte, entries *map[string]WhoisCacheData) error {
+	return json.Unmarshal(data, entries)
+}
+
+// cacheSaveMu serializes saveCache between periodic flushes and the save at
+// the end of a run.
+var cacheSaveMu sync.Mutex
+
+// saveCache writes the live WHOIS cache entries, encrypted when a key is
+// configured. The gob format is gzipped; the JSON format is left readable.
+// The file is written to a temporary file and renamed into place, so a
+// crash mid-write leaves the previous cache intact.
+func saveCache() error {
+	cacheSaveMu.Lock()
+	defer cacheSaveMu.Unlock()
+
+	compactCache()
+	cacheData, err := encodeCacheEntries(whoisCache.snapshot())
+	if err != nil {
+		return err
+	}
+
+	if key := cacheKey(); key != nil {
+		sealed, err := encryptCache(cacheData, key)
+		if err != nil {
+			return err
+		}
+		cacheData = append(bytes.Clone(encryptedCacheMagic), sealed...)
+	}
+
+	tmp := cacheFile + ".tmp"
+	if err := os.WriteFile(tmp, cacheData, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cacheFile)
+}
+
+// flushCachePeriodically saves the cache every interval until the returned
+// function is called. Errors are logged, and the next flush tries again.
+func flushCachePeriodically(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := saveCache(); err != nil {
+					slog.Warn("Error flushing cache", "path", cacheFile, "error", err)
+				} else {
+					slog.Debug("Flushed cache", "path", cacheFile)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+func encodeCacheEntries(entries map[string]WhoisCacheData) ([]byte, error) {
+	switch config.Cache.Format {
+	case "json":
+		return json.MarshalIndent(entries, "", "  ")
+	case "", "gob":
+		var b bytes.Buffer
+		gz := gzip.NewWriter(&b)
+		if err := gob.NewEncoder(gz).Encode(entries); err != nil {
+			return nil, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unknown cache format %q", config.Cache.Format)
+	}
+}
+
+func encryptCache(plaintext, key []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func decryptCache(ciphertext, key []byte) ([]byte, error) {
+	if key == nil {
+		return nil, errors.New("cache is encrypted but no key is configured")
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("cache file is truncated")
+	}
+
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWhoisLRUEvictsOldest(t *testing.T) {
+	const maxEntries = 3
+	c := newWhoisLRU(maxEntries)
+
+	for i := range 5 {
+		c.Put(fmt.Sprintf("192.0.2.%d", i), WhoisCacheData{CdnOrgName: fmt.Sprint(i)})
+	}
+
+	if n := c.Len(); n != maxEntries {
+		t.Fatalf("Len() = %d, want %d", n, maxEntries)
+	}
+	for i := range 2 {
+		if _, ok := c.Get(fmt.Sprintf("192.0.2.%d", i)); ok {
+			t.Errorf("192.0.2.%d still cached, want evicted", i)
+		}
+	}
+	for i := 2; i < 5; i++ {
+		if _, ok := c.Get(fmt.Sprintf("192.0.2.%d", i)); !ok {
+			t.Errorf("192.0.2.%d evicted, want cached", i)
+		}
+	}
+}
+
+func TestWhoisLRUGetRefreshesRecency(t *testing.T) {
+	c := newWhoisLRU(2)
+	c.Put("192.0.2.1", WhoisCacheData{})
+	c.Put("192.0.2.2", WhoisCacheData{})
+
+	// Using .1 makes .2 the least recently used.
+	c.Get("192.0.2.1")
+	c.Put("192.0.2.3", WhoisCacheData{})
+
+	if _, ok := c.Get("192.0.2.1"); !ok {
+		t.Error("192.0.2.1 evicted, want cached")
+	}
+	if _, ok := c.Get("192.0.2.2"); ok {
+		t.Error("192.0.2.2 still cached, want evicted")
+	}
+}
+
+func TestWhoisLRULoadKeepsNewest(t *testing.T) {
+	now := time.Now()
+	c := newWhoisLRU(2)
+	c.load(map[string]WhoisCacheData{
+		"192.0.2.1": {Timestamp: now.Add(-3 * time.Hour)},
+		"192.0.2.2": {Timestamp: now.Add(-time.Hour)},
+		"192.0.2.3": {Timestamp: now.Add(-2 * time.Hour)},
+	})
+
+	if _, ok := c.Get("192.0.2.1"); ok {
+		t.Error("oldest entry 192.0.2.1 kept, want evicted on load")
+	}
+	for _, ip := range []string{"192.0.2.2", "192.0.2.3"} {
+		if _, ok := c.Get(ip); !ok {
+			t.Errorf("%s evicted on load, want cached", ip)
+		}
+	}
+}
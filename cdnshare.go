@@ -1,23 +1,29 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"database/sql"
-	"encoding/gob"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"maps"
 	"net"
 	"net/url"
 	"os"
+	"path"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/chromedp/cdproto/emulation"
 	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/runtime"
 	"github.com/chromedp/chromedp"
 	_ "github.com/go-sql-driver/mysql"
-	"github.com/ipinfo/go/v2/ipinfo"
 	"github.com/likexian/whois"
 )
 
@@ -32,39 +38,381 @@ type Config struct {
 		Password     string `json:"password"`
 		MaxOpenConns int    `json:"maxOpenConns"`
 		MaxIdleConns int    `json:"maxIdleConns"`
+		// TLS encrypts the connection. It is off by default.
+		TLS DatabaseTLS `json:"tls"`
+		// Socket connects over this Unix socket instead of TCP to Host and
+		// Port.
+		Socket string `json:"socket"`
+		// Partitioning is "none" (default) or "date", which creates new
+		// account tables sorted by timestamp.
+		Partitioning string `json:"partitioning"`
+		// RawWhois stores each IP's raw lookup answer once in the whois_raw
+		// table.
+		RawWhois bool `json:"rawWhois"`
 	} `json:"database"`
 
+	// Output configures a single sink. Outputs, when set, takes precedence
+	// and sends every row to each of the listed sinks.
+	Output  OutputConfig   `json:"output"`
+	Outputs []OutputConfig `json:"outputs"`
+
+	Log struct {
+		// Format is "text" (default) or "json".
+		Format string `json:"format"`
+		// Level is one of "debug", "info" (default), "warn" or "error".
+		Level string `json:"level"`
+	} `json:"log"`
+
+	Metrics struct {
+		// Addr is the listen address for the Prometheus /metrics endpoint.
+		// The server is not started when empty.
+		Addr string `json:"addr"`
+	} `json:"metrics"`
+
+	Health struct {
+		// Addr is the listen address for the /healthz and /readyz probes.
+		// The server is not started when empty.
+		Addr string `json:"addr"`
+	} `json:"health"`
+
+	Detection struct {
+		// Enabled fuses WHOIS org, ASN, PTR, CNAME and response header
+		// signals to pick the CDN, and records a confidence score.
+		Enabled bool `json:"enabled"`
+		// TLS adds the edge certificate's issuer and SANs as signals. It
+		// costs an extra TLS handshake per edge IP.
+		TLS bool `json:"tls"`
+		// Rules are fingerprint rules that name the CDN from a combination
+		// of signals, taking precedence over the vote between them.
+		Rules []FingerprintRule `json:"rules"`
+	} `json:"detection"`
+
+	ChangeDetection struct {
+		// Enabled records a row in cdn_changes whenever the CDN org for an
+		// account, hostname and stream type differs from the last one stored.
+		Enabled bool `json:"enabled"`
+	} `json:"changeDetection"`
+
+	Webhook WebhookConfig `json:"webhook"`
+	Slack   SlackConfig   `json:"slack"`
+
+	IPInfo struct {
+		Token string `json:"token"`
+		// Tokens are used round-robin, skipping any that are rate limited
+		// or out of quota. Token is added to the pool when both are set.
+		Tokens []string `json:"tokens"`
+	} `json:"ipinfo"`
+
+	Lookup struct {
+		// RequestsPerSecond throttles calls to the ipinfo/whois providers.
+		// Zero means unlimited.
+		RequestsPerSecond float64 `json:"requestsPerSecond"`
+		// MaxLookups caps the provider calls made in one run. Once it is
+		// reached, only cached results are used. Zero means unlimited.
+		MaxLookups int `json:"maxLookups"`
+		// IPConcurrency bounds how many of a hostname's IPs are looked up
+		// at once when all of them are.
+		IPConcurrency int `json:"ipConcurrency"`
+		// AllIPs looks up, and records, every IP a media hostname resolves
+		// to instead of only the first.
+		AllIPs bool `json:"allIPs"`
+		// CostPerLookup is the price of one provider call, in any currency,
+		// used to put a cost on the lookup estimate and the run summary.
+		CostPerLookup float64 `json:"costPerLookup"`
+		// WhoisRetry retries WHOIS queries that fail with a timeout, a
+		// dropped connection or rate limiting.
+		WhoisRetry RetryConfig `json:"whoisRetry"`
+		// WhoisTimeoutSeconds bounds each WHOIS query, so a server that
+		// accepts the connection but never answers can't stall a capture.
+		WhoisTimeoutSeconds int `json:"whoisTimeoutSeconds"`
+		// WhoisRIRRequestsPerSecond throttles WHOIS queries per regional
+		// registry ("arin", "ripencc", "apnic", "lacnic", "afrinic"), on
+		// top of RequestsPerSecond. "default" covers the others.
+		WhoisRIRRequestsPerSecond map[string]float64 `json:"whoisRirRequestsPerSecond"`
+		// WhoisServers force the WHOIS server for matching IP ranges or
+		// hostnames. The first matching entry wins.
+		WhoisServers []WhoisServerOverride `json:"whoisServers"`
+		// CircuitBreaker skips a provider for CooldownSeconds after
+		// FailureThreshold consecutive failures, then tries it again with a
+		// single probe. A negative threshold disables it.
+		CircuitBreaker struct {
+			FailureThreshold int `json:"failureThreshold"`
+			CooldownSeconds  int `json:"cooldownSeconds"`
+		} `json:"circuitBreaker"`
+		// Providers lists the lookup providers to try, in order, on a cache
+		// miss. See lookupProviders.
+		Providers []string `json:"providers"`
+		// DetectionMethod is the default for accounts that don't set one.
+		DetectionMethod string `json:"detectionMethod"`
+	} `json:"lookup"`
+
+	Incremental struct {
+		// MaxAgeSeconds skips a URL if it produced observations within this
+		// many seconds. Zero disables incremental mode.
+		MaxAgeSeconds int `json:"maxAgeSeconds"`
+		// StateFile records when each URL last succeeded.
+		StateFile string `json:"stateFile"`
+	} `json:"incremental"`
+
+	Resume struct {
+		// MaxAgeSeconds skips an account that finished all its URLs within
+		// this many seconds, and the URLs of an unfinished account visited
+		// within it. Zero disables resuming.
+		MaxAgeSeconds int `json:"maxAgeSeconds"`
+		// StateFile records each account's progress.
+		StateFile string `json:"stateFile"`
+	} `json:"resume"`
+
+	Cache struct {
+		// EncryptionKey, when set, encrypts the cache file with AES-GCM using
+		// a key derived from this passphrase. CDNSHARE_CACHE_KEY overrides it.
+		EncryptionKey string `json:"encryptionKey"`
+		// MaxEntries caps the number of cached IPs, evicting the least
+		// recently used. Zero means unbounded.
+		MaxEntries int `json:"maxEntries"`
+		// Format is "gob" (default) or "json" for a human-readable file.
+		Format string `json:"format"`
+		// ByPrefix also caches each result under the IP's network prefix,
+		// so one lookup covers every edge IP in that range.
+		ByPrefix bool `json:"byPrefix"`
+		// NegativeTTLSeconds is how long a failed lookup is remembered, so
+		// the same IP isn't retried on every segment. It defaults to 300;
+		// a negative value disables it.
+		NegativeTTLSeconds int `json:"negativeTtlSeconds"`
+		// FlushIntervalSeconds also saves the cache this often during a
+		// run, so a crash loses at most that much lookup work. Zero saves
+		// it only when the run ends.
+		FlushIntervalSeconds int `json:"flushIntervalSeconds"`
+		// MaxAgeDays drops entries looked up longer ago than this when the
+		// cache is loaded and saved, so they are looked up afresh and the
+		// file stays bounded. Zero keeps entries forever.
+		MaxAgeDays int `json:"maxAgeDays"`
+		// File is the cache file, whois_cache.gob by default. Namespace is
+		// added before its extension (whois_cache.staging.gob) so
+		// environments sharing a host keep separate caches.
+		File      string `json:"file"`
+		Namespace string `json:"namespace"`
+	} `json:"cache"`
+
+	// RunTimeoutSeconds caps the whole run. When it expires, collection is
+	// cancelled, buffered data is flushed and the process exits with status
+	// 124. The -timeout flag overrides it.
+	RunTimeoutSeconds int `json:"runTimeoutSeconds"`
+
+	Latency LatencyConfig `json:"latency"`
+
+	Outcome struct {
+		// StatusRows writes a row with an empty CDN and the outcome for each
+		// URL that produced no observations.
+		StatusRows bool `json:"statusRows"`
+	} `json:"outcome"`
+
+	Retention struct {
+		// MaxAgeDays deletes rows older than this from each account's table
+		// at the end of a run. Zero keeps rows forever.
+		MaxAgeDays int `json:"maxAgeDays"`
+		// BatchSize is the number of rows deleted per statement.
+		BatchSize int `json:"batchSize"`
+	} `json:"retention"`
+
+	Dedup struct {
+		// Scope is "account" (the default) to record each hostname, IP and
+		// stream type once per account per run, "global" to record it once
+		// per run across all accounts, or "none" to record every request.
+		Scope string `json:"scope"`
+	} `json:"dedup"`
+
+	// JitterPercent randomly lengthens capture windows, and varies lookup
+	// spacing, by up to this percentage, to avoid synchronized load spikes.
+	// Zero disables it.
+	JitterPercent float64 `json:"jitterPercent"`
+
+	Browser struct {
+		// RemoteURL is the DevTools HTTP or WebSocket endpoint of a running
+		// Chrome to open tabs on, instead of launching a local one.
+		RemoteURL string `json:"remoteUrl"`
+	} `json:"browser"`
+
+	Watch struct {
+		// IntervalSeconds, when set, keeps the process running and collects
+		// again this long after each run finishes. The -watch flag
+		// overrides it and -once disables it.
+		IntervalSeconds int `json:"intervalSeconds"`
+	} `json:"watch"`
+
+	// MaxBrowsers caps how many browser tabs are open at once across all
+	// accounts, to bound Chrome's memory use. Zero means no limit.
+	MaxBrowsers int `json:"maxBrowsers"`
+
+	// MaxCapturesPerURL stops processing a URL's matched requests after
+	// this many, ending its capture early, for every account that does not
+	// set its own. Zero means no limit.
+	MaxCapturesPerURL int `json:"maxCapturesPerURL"`
+
+	// URLConcurrency is how many of an account's URLs are collected at
+	// once, for every account that does not set its own. It defaults to 1,
+	// one URL after another; maxBrowsers still caps the total.
+	URLConcurrency int `json:"urlConcurrency"`
+
+	// Shuffle collects accounts, and each account's URLs, in a random
+	// order every run, so a run cut short by its timeout doesn't always
+	// skip the same ones. A non-zero Seed makes the order reproducible.
+	Shuffle struct {
+		Enabled bool  `json:"enabled"`
+		Seed    int64 `json:"seed"`
+	} `json:"shuffle"`
+
+	OrgNames OrgNamesConfig `json:"orgNames"`
+
+	// UserAgent replaces Chrome's default User-Agent for every account that
+	// does not set its own.
+	UserAgent string `json:"userAgent"`
+
+	// Timezone is the zone observation timestamps are recorded in: "UTC"
+	// (default), "Local" for the collector's zone, or an IANA name.
+	Timezone string `json:"timezone"`
+
+	// Emulation makes the browser emulate a device, such as a phone, for
+	// every account that does not set its own.
+	Emulation *Emulation `json:"emulation"`
+
 	Accounts []Account `json:"accounts"`
 }
 
 type Account struct {
-	Name             string            `json:"name"`
-	Unit             string            `json:"unit"`
-	ID               string            `json:"id"`
-	URLs             map[string]string `json:"urls"`
-	MediaTypeFilters []string          `json:"mediaTypeFilters"`
-	SleepDuration    int64             `json:"sleepDuration"`
-	DBTableName      string            `json:"db_table_name"`
+	Name string     `json:"name"`
+	Unit string     `json:"unit"`
+	ID   string     `json:"id"`
+	URLs StreamURLs `json:"urls"`
+	// URLsFile names a file of "streamType,url" lines to collect in addition
+	// to URLs. "-" reads from stdin.
+	URLsFile         string   `json:"urlsFile"`
+	MediaTypeFilters []string `json:"mediaTypeFilters"`
+	// StripQueryParams lists query parameters, such as signed tokens, to
+	// remove from matched URLs before they are used. "*" removes them all.
+	StripQueryParams []string `json:"stripQueryParams"`
+	// DetectStreamType classifies the stream as live or ondemand from the
+	// HLS or DASH manifests the page loads, overriding the configured type.
+	DetectStreamType bool `json:"detectStreamType"`
+	// RecordMatchedURL stores the full matched URL, after StripQueryParams,
+	// with each observation instead of only its host.
+	RecordMatchedURL bool `json:"recordMatchedURL"`
+	// ExtraColumns maps additional column names to the source of their
+	// value: "whois:<field>", "ipinfo:<attribute>" or "literal:<value>".
+	ExtraColumns map[string]string `json:"extraColumns"`
+	// DetectionMethod selects how the CDN org is found: "auto" tries
+	// lookup.providers in order, "headers" uses CDN response headers only,
+	// and a provider name ("ipinfo", "whois", "rdap", "cymru") uses just that
+	// provider. It defaults to lookup.detectionMethod.
+	DetectionMethod string `json:"detectionMethod"`
+	// Cookies are set in the browser before each of the account's URLs is
+	// loaded, for sites that require a login. CookiesFile adds cookies from
+	// a Netscape cookie file, as exported by curl or a browser extension.
+	Cookies     []Cookie `json:"cookies"`
+	CookiesFile string   `json:"cookiesFile"`
+	// Headers are added to every request the browser makes, e.g.
+	// Authorization.
+	Headers map[string]string `json:"headers"`
+	// UserAgent overrides the browser's User-Agent, falling back to the
+	// global userAgent and then Chrome's default.
+	UserAgent string `json:"userAgent"`
+	// Emulation makes the browser emulate a device, overriding the global
+	// emulation. An explicit UserAgent replaces the device's.
+	Emulation *Emulation `json:"emulation"`
+	// SleepDuration is the capture window, in seconds, that each URL is left
+	// open for in collectStreamingURLs. It does not throttle lookups.
+	SleepDuration int64 `json:"sleepDuration"`
+	// CaptureTimeoutSeconds is a hard ceiling on how long one URL may take,
+	// including navigation. Zero means no limit.
+	CaptureTimeoutSeconds int64  `json:"captureTimeoutSeconds"`
+	DBTableName           string `json:"db_table_name"`
+	// MaxCapturesPerURL overrides the global maxCapturesPerURL.
+	MaxCapturesPerURL int `json:"maxCapturesPerURL"`
+	// URLConcurrency overrides the global urlConcurrency.
+	URLConcurrency int `json:"urlConcurrency"`
+
+	fileURLs    []StreamURL
+	fileCookies []Cookie
 }
 
 type CdnShareData struct {
-	Timestamp          time.Time
-	CdnIp              string
-	CustomerHostname   string
-	CdnOrgName         string
-	CustomerStreamType string
-	AccountName        string
-	AccountUnit        string
-	AccountID          string
-	ParsedWhois        string
+	Timestamp          time.Time `json:"timestamp"`
+	CdnIp              string    `json:"cdn_ip"`
+	CustomerHostname   string    `json:"hostname"`
+	CdnOrgName         string    `json:"cdn_orgname"`
+	CustomerStreamType string    `json:"stream_type"`
+	AccountName        string    `json:"account_name"`
+	AccountUnit        string    `json:"account_unit"`
+	AccountID          string    `json:"account_id"`
+	ParsedWhois        string    `json:"whois,omitempty"`
+	// Confidence is the share of detection signals that agreed on
+	// CdnOrgName, and Alternatives the other CDNs they named. Both are only
+	// set when Detection is enabled.
+	Confidence   float64     `json:"confidence,omitempty"`
+	Alternatives []Candidate `json:"alternatives,omitempty"`
+	TLSIssuer    string      `json:"tls_issuer,omitempty"`
+	// Prefix is the network CIDR (BGP prefix) CdnIp belongs to, when the
+	// lookup provider reports one.
+	Prefix string `json:"prefix,omitempty"`
+	// StreamTypeSource records where CustomerStreamType came from ("hls",
+	// "dash" or "config") when the account has DetectStreamType set.
+	StreamTypeSource string `json:"stream_type_source,omitempty"`
+	// WebSocket is set when the media was delivered over a WebSocket rather
+	// than plain HTTP requests.
+	WebSocket bool `json:"websocket,omitempty"`
+	// TimeToFirstSegmentMs is set on the first row from each URL: the time
+	// from requesting the page to its first media request.
+	TimeToFirstSegmentMs int64 `json:"time_to_first_segment_ms,omitempty"`
+	// LatencyMs is the median round trip to CdnIp when the latency probe is
+	// enabled, and unset if the edge did not answer.
+	LatencyMs float64 `json:"latency_ms,omitempty"`
+
+	// Outcome is "ok" for observations, or why a capture produced none
+	// ("geo_blocked", "no_media" or "error") on status rows.
+	Outcome string `json:"outcome,omitempty"`
+	// EmulationProfile names the emulated device the observation was made
+	// with, empty for the default desktop browser.
+	EmulationProfile string `json:"emulation_profile,omitempty"`
+	// RequestMethod and ResourceType are the HTTP method of the media
+	// request and its Chrome resource type ("Media", "XHR", "Fetch",
+	// "Document", "WebSocket", ...).
+	RequestMethod string `json:"request_method,omitempty"`
+	ResourceType  string `json:"resource_type,omitempty"`
+	// CdnProviders is the sorted, comma-separated set of CDN orgs seen
+	// serving the hostname and stream type in a capture, and MultiCDN is set
+	// when there is more than one. Only the capture's providers row, written
+	// when it ends, has them.
+	CdnProviders string `json:"cdn_providers,omitempty"`
+	MultiCDN     bool   `json:"multi_cdn,omitempty"`
+	// MatchedURL is the media URL the observation was made from, with the
+	// account's recordMatchedURL.
+	MatchedURL string `json:"matched_url,omitempty"`
+	// Extra holds the account's ExtraColumns values.
+	Extra map[string]string `json:"extra,omitempty"`
+
+	// table is the destination table for database sinks.
+	table string
+	// ipinfo holds the ipinfo attributes of the lookup, if it used ipinfo.
+	ipinfo map[string]string
 }
 
 type WhoisCacheData struct {
 	Timestamp   time.Time
 	CdnOrgName  string
 	ParsedWhois string
+	// Prefix is the network CIDR the IP belongs to, if the provider gave one.
+	Prefix string
+	// IPInfo holds the ipinfo attributes used by extra columns, when the IP
+	// was looked up with ipinfo.
+	IPInfo map[string]string
+	// Provider is the lookup provider that produced the entry.
+	Provider string
 }
 
+// defaultWhoisFields are the WHOIS fields tried, in order, for the org name
+// when who falls back to a WHOIS lookup.
+var defaultWhoisFields = []string{"OrgName", "org-name", "Organization", "owner", "descr"}
+
 var cdnOrgNameMappings = []PrettyNameMapping{
 	{
 		Pattern:    "Eweka",
@@ -92,209 +440,1126 @@ var cdnOrgNameMappings = []PrettyNameMapping{
 
 var config Config
 var db *sql.DB
-var whoisCache = make(map[string]WhoisCacheData)
-var cacheFile = "whois_cache.gob"
+var whoisCache = newWhoisLRU(0)
+var cacheFile = defaultCacheFile
+var sink Sink
+var dryRun bool
+var lookupLimiter *rateLimiter
+var ipinfoTokens *tokenPool
+var stats = newRunStats()
+var incremental *incrementalState
+var resume *resumeState
+
+// Exit statuses. Setup errors such as an unreachable database exit with
+// exitError via fatal.
+const (
+	exitOK             = 0
+	exitError          = 1
+	exitConfigError    = 2
+	exitPartialFailure = 3
+	exitTotalFailure   = 4
+	// exitTimeout matches timeout(1).
+	exitTimeout = 124
+)
 
+// main runs a subcommand: "collect" (the default, so existing invocations
+// without one keep working), "query", "replay", "lookup" or "validate".
 func main() {
-	configFile, err := os.ReadFile("config.json")
+	args := os.Args[1:]
+	cmd := "collect"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "collect":
+		os.Exit(runCollect(args))
+	case "query":
+		os.Exit(runQuery(args))
+	case "replay":
+		os.Exit(runReplay(args))
+	case "lookup":
+		os.Exit(runLookup(args))
+	case "validate":
+		os.Exit(runValidate(args))
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q, expected collect, query, replay, lookup or validate\n", cmd)
+		os.Exit(exitConfigError)
+	}
+}
+
+// timestampLocation is the zone of observation timestamps, from the
+// timezone setting.
+var timestampLocation = time.UTC
+
+// observationTime returns the current time in timestampLocation, for the
+// Timestamp of observations.
+func observationTime() time.Time {
+	return time.Now().In(timestampLocation)
+}
+
+// setup loads the config and installs the configured logger.
+func setup() error {
+	var err error
+	config, err = loadConfig(configPath())
+	if err != nil {
+		return err
+	}
+	timestampLocation, err = time.LoadLocation(config.Timezone)
+	if err != nil {
+		return err
+	}
+
+	logger, err := newLogger(os.Stderr, config.Log.Format, config.Log.Level)
+	if err != nil {
+		return fmt.Errorf("error configuring logger: %w", err)
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+func runCollect(args []string) int {
+	fs := flag.NewFlagSet("collect", flag.ExitOnError)
+	summaryJSON := fs.String("summary-json", "", "write the run summary as JSON to this path")
+	distribution := fs.String("distribution", "", "write each account's share of hostnames per CDN org to this path, as CSV if it ends in .csv and JSON otherwise")
+	accounts := fs.String("accounts", "", "comma-separated account names to collect (default all)")
+	exclude := fs.String("exclude", "", "comma-separated account names to skip")
+	types := fs.String("stream-types", "", "comma-separated stream types to collect, such as live,ondemand (default all)")
+	fs.BoolVar(&dryRun, "dry-run", false, "collect and look up as usual, but only write rows to stdout outputs and do not save the cache")
+	fs.StringVar(&cacheFlag, "cache", "", "use this cache file, overriding cache.file and cache.namespace")
+	printConfig := fs.Bool("print-config", false, "print the effective config, with secrets redacted, and exit")
+	timeout := fs.Duration("timeout", 0, "stop the run after this long (overrides runTimeoutSeconds)")
+	fs.BoolVar(&debugRequests, "debug", false, "log every request the browser makes, and whether it matched the media filters, at debug level")
+	fs.StringVar(&harDir, "har-dir", "", "write a HAR file of each page load to this directory")
+	watch := fs.Duration("watch", 0, "collect repeatedly, waiting this long between runs, and reload accounts when config.json changes (overrides watch.intervalSeconds)")
+	fs.BoolVar(&showProgress, "progress", false, "show progress while collecting: a status line on a terminal, otherwise a log line every 30s")
+	once := fs.Bool("once", false, "collect once and exit, even if watch.intervalSeconds is set")
+	fs.StringVar(&debugDir, "debug-dir", "", "with -debug, also write each URL's requests to a file in this directory")
+	fs.Parse(args)
+
+	err := setup()
+	if err != nil {
+		slog.Error("Error loading config", "error", err)
+		return exitConfigError
+	}
+
+	if debugRequests {
+		config.Log.Level = "debug"
+		logger, err := newLogger(os.Stderr, config.Log.Format, config.Log.Level)
+		if err != nil {
+			slog.Error("Error configuring logger", "error", err)
+			return exitConfigError
+		}
+		slog.SetDefault(logger)
+	}
+
+	config.Accounts = filterAccounts(config.Accounts, splitList(*accounts), splitList(*exclude))
+
+	if *printConfig {
+		b, err := redactedConfigJSON(config)
+		if err != nil {
+			fatal("Error printing config", "error", err)
+		}
+		fmt.Println(string(b))
+		return exitOK
+	}
+
+	err = loadURLsFiles(config.Accounts)
 	if err != nil {
-		log.Fatalln("Error reading config file:", err)
+		slog.Error("Error loading URLs file", "error", err)
+		return exitConfigError
 	}
 
-	err = json.Unmarshal(configFile, &config)
+	err = loadCookiesFiles(config.Accounts)
 	if err != nil {
-		log.Fatalln("Error unmarshalling JSON:", err)
+		slog.Error("Error loading cookies file", "error", err)
+		return exitConfigError
 	}
 
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s", config.Database.User, config.Database.Password, config.Database.Host, config.Database.Port, config.Database.Database)
+	streamTypes = splitList(*types)
+	warnUnknownStreamTypes(config.Accounts)
+
+	if config.Metrics.Addr != "" {
+		startMetricsServer(config.Metrics.Addr)
+	}
 
-	db, err = sql.Open("mysql", dsn)
+	sink, err = openSinks(config.Outputs)
 	if err != nil {
-		log.Fatalln("Error opening database:", err)
+		fatal("Error opening outputs", "error", err)
+	}
+
+	if config.Health.Addr != "" {
+		startHealthServer(config.Health.Addr)
 	}
 
+	collector, err := NewCollector(config, sink)
+	if err != nil {
+		fatal("Error starting collector", "error", err)
+	}
 	defer func() {
-		if err := db.Close(); err != nil {
-			log.Fatalln("Error closing database:", err)
+		if err := collector.Close(); err != nil {
+			fatal("Error closing outputs", "error", err)
+		}
+		// The database handle outlives the sink, for retention and
+		// health checks, so it is closed last.
+		if db != nil {
+			db.Close()
 		}
 	}()
 
-	err = loadCache()
+	if *timeout == 0 {
+		*timeout = time.Duration(config.RunTimeoutSeconds) * time.Second
+	}
+
+	if *once {
+		*watch = 0
+	} else if *watch == 0 {
+		*watch = time.Duration(config.Watch.IntervalSeconds) * time.Second
+	}
+	if *watch == 0 {
+		status, err := runCycle(collector, *timeout, *summaryJSON, *distribution)
+		if err != nil {
+			// Returning rather than exiting lets the deferred Close flush
+			// the outputs.
+			slog.Error("Run failed", "error", err)
+			return exitError
+		}
+		return status
+	}
+
+	w, err := newConfigWatcher(configPath(), splitList(*accounts), splitList(*exclude))
 	if err != nil {
-		log.Fatalln("Error loading cache:", err)
+		fatal("Error watching config", "error", err)
 	}
+	stop := stopSignals()
+	for {
+		status, err := runCycle(collector, *timeout, *summaryJSON, *distribution)
+		if err != nil {
+			slog.Error("Run failed", "error", err)
+			return exitError
+		}
+		slog.Info("Collection run finished", "exit_status", status, "next_in", *watch)
+		select {
+		case <-stop:
+			return status
+		case <-time.After(*watch):
+		}
 
-	var wg sync.WaitGroup
-	for _, account := range config.Accounts {
-		wg.Add(1)
-		go func(account Account) {
-			defer wg.Done()
-			for streamType, url := range account.URLs {
-				collectStreamingURLs(account, url, streamType)
-			}
-		}(account)
+		w.apply()
 	}
-	wg.Wait()
+}
+
+// runCycle runs collector once, prints the summary and returns the exit
+// status for the run. An error means state or reports could not be written,
+// and the process should stop once the outputs are closed.
+func runCycle(collector *Collector, timeout time.Duration, summaryJSON, distribution string) (int, error) {
+	var err error
 
-	err = saveCache()
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// Without a remote browser, each capture's context launches its own
+	// local Chrome.
+	if config.Browser.RemoteURL != "" {
+		var cancel context.CancelFunc
+		ctx, cancel, err = connectRemoteBrowser(ctx, config.Browser.RemoteURL)
+		if err != nil {
+			slog.Error("Remote browser unavailable", "error", err)
+			return exitTotalFailure, nil
+		}
+		defer cancel()
+	}
+
+	summary, err := collector.Run(ctx)
+
+	timedOut := errors.Is(ctx.Err(), context.DeadlineExceeded)
+	if timedOut {
+		slog.Error("Run timed out", "timeout", timeout)
+	}
 	if err != nil {
-		log.Fatalln("Error saving cache:", err)
+		return 0, fmt.Errorf("error saving state: %w", err)
+	}
+
+	printSummary(os.Stderr, summary)
+	notifySlackRunErrors(summary)
+	if summaryJSON != "" {
+		if err := writeSummaryJSON(summaryJSON, summary); err != nil {
+			return 0, fmt.Errorf("error writing summary %s: %w", summaryJSON, err)
+		}
+	}
+	if distribution != "" {
+		if err := writeDistribution(distribution, summary); err != nil {
+			return 0, fmt.Errorf("error writing CDN distribution %s: %w", distribution, err)
+		}
 	}
+
+	if timedOut {
+		return exitTimeout, nil
+	}
+	return exitStatus(summary), nil
+}
+
+// exitStatus summarizes a finished run: any errors make it a partial
+// failure, and errors with no rows written at all make it a total failure.
+func exitStatus(r RunSummary) int {
+	switch {
+	case r.Errors == 0:
+		return exitOK
+	case r.RowsWritten == 0:
+		return exitTotalFailure
+	default:
+		return exitPartialFailure
+	}
+}
+
+// capture holds the state of collecting a single page URL.
+type capture struct {
+	account    Account
+	url        string
+	streamType string
+
+	// requests and matched count the requests seen on this page and those
+	// that matched the media filters.
+	requests atomic.Int64
+	matched  atomic.Int64
+	// rows counts observations written from this page, and deduped and
+	// capped the matches skipped because they were already observed or
+	// over maxCapturesPerURL.
+	rows    atomic.Int64
+	deduped atomic.Int64
+	capped  atomic.Int64
+	// captures counts matched requests handed to processFilteredRequest,
+	// and full is closed once maxCapturesPerURL of them were processed.
+	captures atomic.Int64
+	full     chan struct{}
+	fullOnce sync.Once
+
+	mu sync.Mutex
+	// headers holds the latest response headers seen per host.
+	headers map[string]map[string]string
+	// manifests holds the kind of manifest responses still loading, and
+	// detectedStreamType the stream type classified from one, if any.
+	manifests          map[network.RequestID]string
+	detectedStreamType string
+	streamTypeSource   string
+	// blockedResponses counts 451s, and 403s for the page or its media.
+	blockedResponses atomic.Int64
+	// overBudget counts lookups skipped because of lookup.maxLookups.
+	overBudget atomic.Int64
+	// console holds the page's console output and exceptions.
+	console []string
+	// har records the page load with -har-dir.
+	har *harRecorder
+	// requestDump receives every request URL with -debug-dir.
+	requestDump *os.File
+	// methods holds the method of matching requests awaiting their
+	// response, with header detection.
+	methods map[network.RequestID]string
+	// providers holds the CDN orgs seen per hostname and stream type.
+	providers map[multiCDNKey]map[string]struct{}
+	// sockets holds matching WebSockets that have not delivered a frame yet.
+	sockets map[network.RequestID]string
+	// navStart is when the main document was requested and firstSegment
+	// how long after that the first media request fired.
+	navStart         time.Time
+	firstSegment     time.Duration
+	firstSegmentSent bool
+
+	// ctx ends with the run, and bounds the lookups made for the page. The
+	// capture's timeout only bounds the browser, so matches seen before it
+	// are still looked up and recorded.
+	ctx context.Context
+	// matches queues matched requests for the worker started by
+	// startMatchWorker, so lookups don't hold up chromedp's event
+	// listener. It is nil when replaying, which processes matches inline.
+	matches chan pendingMatch
+	// workerDone is closed when the match worker exits.
+	workerDone chan struct{}
+
+	// replayIPs and replayTime are set when replaying a HAR: the server IP
+	// each host was reached at and when the current request was made.
+	replayIPs  map[string]net.IP
+	replayTime time.Time
 }
 
-func collectStreamingURLs(account Account, url string, streamType string) {
-	ctx, cancel := chromedp.NewContext(context.Background())
+func collectStreamingURLs(runCtx context.Context, account Account, url string, streamType string) {
+	key := incrementalKey(account, url, streamType)
+	if incremental.fresh(key) {
+		slog.Info("Skipping recently collected URL", "account", account.Name, "url", url, "stream_type", streamType)
+		return
+	}
+
+	if err := acquireBrowser(runCtx); err != nil {
+		slog.Warn("Capture stopped by run timeout", "account", account.Name, "url", url)
+		return
+	}
+	defer releaseBrowser()
+
+	ctx, cancel := chromedp.NewContext(runCtx)
 	defer cancel()
 
-	err := chromedp.Run(ctx,
-		network.Enable(),
+	if account.CaptureTimeoutSeconds > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(account.CaptureTimeoutSeconds)*time.Second)
+		defer cancel()
+	}
+
+	stats.urlVisited()
+
+	c := &capture{account: account, url: url, streamType: streamType, ctx: runCtx, full: make(chan struct{})}
+	if harDir != "" {
+		c.har = newHARRecorder()
+		defer func() {
+			if err := c.har.write(c); err != nil {
+				slog.Warn("Error writing HAR file", "account", account.Name, "url", url, "error", err)
+			}
+		}()
+	}
+	if debugRequests && debugDir != "" {
+		f, err := openRequestDump(c)
+		if err != nil {
+			slog.Warn("Error creating request dump", "account", account.Name, "url", url, "error", err)
+		} else {
+			c.requestDump = f
+			defer f.Close()
+		}
+	}
+
+	// Console and exception events help explain pages without media.
+	actions := []chromedp.Action{network.Enable(), runtime.Enable()}
+	if emulate := account.emulateAction(); emulate != nil {
+		actions = append(actions, emulate)
+	}
+	if ua := account.userAgent(); ua != "" {
+		actions = append(actions, emulation.SetUserAgentOverride(ua))
+	}
+	if cookies := account.cookieParams(url); len(cookies) > 0 {
+		actions = append(actions, network.SetCookies(cookies))
+	}
+	if len(account.Headers) > 0 {
+		headers := make(network.Headers, len(account.Headers))
+		for k, v := range account.Headers {
+			headers[k] = v
+		}
+		actions = append(actions, network.SetExtraHTTPHeaders(headers))
+	}
+	actions = append(actions,
 		chromedp.ActionFunc(func(ctx context.Context) error {
-			listenForNetworkEvents(ctx, account, streamType)
+			listenForNetworkEvents(ctx, c)
 			return nil
 		}),
 		chromedp.Navigate(url),
-		chromedp.Sleep(time.Duration(account.SleepDuration)*time.Second),
+		chromedp.ActionFunc(func(ctx context.Context) error {
+			return c.wait(ctx, account.captureWindow())
+		}),
 	)
 
-	if err != nil {
-		log.Printf("Failed to navigate to URL %s: %v\n", url, err)
+	stopMatches := c.startMatchWorker()
+	err := chromedp.Run(ctx, actions...)
+	stopMatches()
+
+	if runCtx.Err() != nil {
+		slog.Warn("Capture stopped by run timeout", "account", account.Name, "url", url, "rows", c.rows.Load())
+		return
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		// The timeout only stopped the browser: stopMatches has looked up
+		// and recorded everything matched before the deadline.
+		slog.Warn("Capture timed out", "account", account.Name, "url", url, "timeout_seconds", account.CaptureTimeoutSeconds, "rows", c.rows.Load())
+	} else if err != nil {
+		stats.error()
+		navigationFailuresTotal.Inc()
+		slog.Error("Failed to navigate to URL", "account", account.Name, "url", url, "error", err)
+		c.reportOutcome(err)
+		return
+	}
+
+	if c.matched.Load() == 0 {
+		stats.urlWithoutMatches()
+		slog.Warn("No requests matched the media filters", "account", account.Name, "url", url, "requests_seen", c.requests.Load(), "requests_matched", c.matched.Load(), "filters", account.MediaTypeFilters)
+		if lines := c.consoleLines(); debugRequests && len(lines) > 0 {
+			slog.Warn("Console output from page without media", "account", account.Name, "url", url, "console", lines)
+		}
+	}
+
+	c.reportMultiCDN()
+	c.reportOutcome(err)
+
+	if c.recorded() {
+		incremental.done(key)
 	}
 }
 
-func listenForNetworkEvents(ctx context.Context, account Account, streamType string) {
+func listenForNetworkEvents(ctx context.Context, c *capture) {
 	chromedp.ListenTarget(ctx, func(ev interface{}) {
 		switch ev := ev.(type) {
 		case *network.EventRequestWillBeSent:
-			processRequest(ev, account, streamType)
+			if c.har != nil {
+				c.har.request(ev)
+			}
+			processRequest(ev, c)
+		case *network.EventResponseReceived:
+			if c.har != nil {
+				c.har.response(ev)
+			}
+			processResponse(ev, c)
+		case *runtime.EventConsoleAPICalled, *runtime.EventExceptionThrown:
+			c.recordConsole(ev)
+		case *network.EventWebSocketCreated:
+			processWebSocketCreated(ev, c)
+		case *network.EventWebSocketFrameReceived:
+			processWebSocketFrame(ev, c)
+		case *network.EventLoadingFailed:
+			if c.har != nil {
+				c.har.failed(ev)
+			}
+		case *network.EventLoadingFinished:
+			if c.har != nil {
+				c.har.finished(ev)
+			}
+			if c.account.DetectStreamType {
+				c.classifyLoadedManifest(ctx, ev.RequestID)
+			}
 		}
 	})
 }
-func processRequest(ev *network.EventRequestWillBeSent, account Account, streamType string) {
-	for _, filter := range account.MediaTypeFilters {
-		if strings.Contains(ev.Request.URL, filter) {
-			processFilteredRequest(ev.Request.URL, account, streamType)
+func processRequest(ev *network.EventRequestWillBeSent, c *capture) {
+	c.requests.Add(1)
+	if ev.Type == network.ResourceTypeDocument {
+		c.markNavigation(ev.Timestamp)
+	}
+	matched := c.matchesFilters(ev.Request.URL)
+	if matched {
+		c.matched.Add(1)
+		c.markFirstSegment(ev.Timestamp)
+	}
+	if debugRequests {
+		debugRequest(c, ev.Request.URL, matched)
+	}
+
+	// With header detection, matches are processed once their response,
+	// and so their headers, has arrived.
+	if c.account.detectionMethod() == "headers" {
+		if matched {
+			c.mu.Lock()
+			if c.methods == nil {
+				c.methods = make(map[network.RequestID]string)
+			}
+			c.methods[ev.RequestID] = ev.Request.Method
+			c.mu.Unlock()
 		}
+		return
+	}
+
+	// A URL matching several filters is still one match, so it counts
+	// once toward maxCapturesPerURL.
+	if matched {
+		c.queueMatch(ev.Request.URL, ev.Request.Method, ev.Type)
+	}
+}
+
+func processResponse(ev *network.EventResponseReceived, c *capture) {
+	c.recordStatus(ev)
+	headersMethod := c.account.detectionMethod() == "headers"
+	if config.Detection.Enabled || headersMethod {
+		c.recordHeaders(ev)
+	}
+	if headersMethod && c.matchesFilters(ev.Response.URL) {
+		c.mu.Lock()
+		method := c.methods[ev.RequestID]
+		delete(c.methods, ev.RequestID)
+		c.mu.Unlock()
+
+		c.queueMatch(ev.Response.URL, method, ev.Type)
+	}
+	if c.account.DetectStreamType {
+		c.noteManifest(ev)
+	}
+}
+
+// processWebSocketCreated remembers WebSockets whose URL matches the media
+// filters. They are recorded once they deliver their first frame.
+func processWebSocketCreated(ev *network.EventWebSocketCreated, c *capture) {
+	c.requests.Add(1)
+	if !c.matchesFilters(ev.URL) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sockets == nil {
+		c.sockets = make(map[network.RequestID]string)
+	}
+	c.sockets[ev.RequestID] = ev.URL
+}
+
+func processWebSocketFrame(ev *network.EventWebSocketFrameReceived, c *capture) {
+	c.mu.Lock()
+	url, ok := c.sockets[ev.RequestID]
+	delete(c.sockets, ev.RequestID)
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	c.matched.Add(1)
+	c.markFirstSegment(ev.Timestamp)
+	c.queueMatch(url, "GET", network.ResourceTypeWebSocket)
+}
+
+// matchQueueSize is how many matched requests may wait for the match worker
+// before the event listener blocks.
+const matchQueueSize = 256
+
+// pendingMatch is a matched request waiting for the match worker.
+type pendingMatch struct {
+	url          string
+	method       string
+	resourceType network.ResourceType
+}
+
+// queueMatch hands a matched request to the match worker, or processes it
+// right away when there is none. It gives up if the worker has stopped or
+// the run has ended.
+func (c *capture) queueMatch(url, method string, resourceType network.ResourceType) {
+	if c.matches == nil {
+		processMatch(url, c, method, resourceType)
+		return
+	}
+	select {
+	case c.matches <- pendingMatch{url, method, resourceType}:
+	case <-c.workerDone:
+	case <-c.ctx.Done():
+	}
+}
+
+// startMatchWorker processes queued matches in the background until the
+// returned stop is called. stop waits for the matches still queued, even
+// after the capture timed out, except that those left when the run has
+// ended are dropped, since their lookups could only fail.
+func (c *capture) startMatchWorker() (stop func()) {
+	c.matches = make(chan pendingMatch, matchQueueSize)
+	c.workerDone = make(chan struct{})
+	quit := make(chan struct{})
+
+	var dropped int
+	process := func(m pendingMatch) {
+		if c.ctx.Err() != nil {
+			dropped++
+			return
+		}
+		processMatch(m.url, c, m.method, m.resourceType)
+	}
+
+	go func() {
+		defer close(c.workerDone)
+		for {
+			select {
+			case m := <-c.matches:
+				process(m)
+			case <-quit:
+				for {
+					select {
+					case m := <-c.matches:
+						process(m)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(quit)
+		<-c.workerDone
+		if dropped > 0 {
+			slog.Debug("Dropped matches queued when the run ended", "account", c.account.Name, "url", c.url, "matches", dropped)
+		}
+	}
+}
+
+// processMatch hands a matched request to processFilteredRequest until the
+// account's maxCapturesPerURL is reached, and then ends the capture.
+func processMatch(url string, c *capture, method string, resourceType network.ResourceType) {
+	limit := int64(c.account.maxCapturesPerURL())
+	n := c.captures.Add(1)
+	if limit > 0 && n > limit {
+		c.capped.Add(1)
+		return
+	}
+
+	stats.requestMatched()
+	processFilteredRequest(url, c, method, resourceType)
+	if limit > 0 && n == limit {
+		c.fullOnce.Do(func() {
+			stats.urlCapped()
+			slog.Debug("Capture limit reached", "account", c.account.Name, "url", c.url, "max_captures", limit)
+			if c.full != nil {
+				close(c.full)
+			}
+		})
+	}
+}
+
+// wait leaves the page open for d, or until the capture limit is reached.
+func (c *capture) wait(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-c.full:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
-func processFilteredRequest(url string, account Account, streamType string) {
-	data, err := who(url)
+func (c *capture) matchesFilters(u string) bool {
+	return slices.ContainsFunc(c.account.MediaTypeFilters, func(filter string) bool {
+		return strings.Contains(u, filter)
+	})
+}
+
+// processFilteredRequest looks up and records the CDN serving url, a media
+// request of the given method and resource type made by the page.
+func processFilteredRequest(url string, c *capture, method string, resourceType network.ResourceType) {
+	account := c.account
+	streamType, streamTypeSource := c.currentStreamType()
+	url = normalizeURL(url, account.StripQueryParams)
+
+	hostname, ips, err := c.resolve(url)
 	if err != nil {
-		log.Println("Error getting WHOIS data:", err)
+		stats.error()
+		slog.Error("Error resolving host", "account", account.Name, "url", url, "error", err)
+		return
+	}
+	if !config.Lookup.AllIPs {
+		ips = ips[:1]
+	}
+
+	var fresh []net.IP
+	var keys []string
+	for _, ip := range ips {
+		key := observed.key(account.Name, hostname, ip.String(), streamType)
+		if !observed.add(key) {
+			c.deduped.Add(1)
+			slog.Debug("Skipping duplicate observation", "account", account.Name, "url", url, "ip", ip.String())
+			continue
+		}
+		fresh = append(fresh, ip)
+		keys = append(keys, key)
+	}
+	if len(fresh) == 0 {
 		return
 	}
 
+	results, orgs := lookupCDNs(c, hostname, fresh)
+	if len(orgs) > 1 {
+		slog.Debug("Hostname resolves to several CDN orgs", "account", account.Name, "url", url, "cdn_orgs", orgs)
+	}
+	for i, r := range results {
+		recordObservation(c, url, keys[i], r, method, resourceType, streamType, streamTypeSource)
+	}
+}
+
+// recordObservation writes the row for the lookup r of one of url's IPs,
+// or undoes its deduplication key if the lookup failed.
+func recordObservation(c *capture, url, key string, r ipLookup, method string, resourceType network.ResourceType, streamType, streamTypeSource string) {
+	account := c.account
+	ip := r.IP
+	data, err := r.Data, r.Err
+	if errors.Is(err, errRecentlyFailed) {
+		observed.remove(key)
+		slog.Debug("Skipping recently failed lookup", "account", account.Name, "url", url, "ip", ip.String())
+		return
+	} else if errors.Is(err, errBudgetExceeded) {
+		observed.remove(key)
+		c.overBudget.Add(1)
+		slog.Debug("Skipping lookup over budget", "account", account.Name, "url", url, "ip", ip.String())
+		return
+	} else if err != nil {
+		observed.remove(key)
+		stats.error()
+		slog.Error("Error getting WHOIS data", "account", account.Name, "url", url, "error", err)
+		return
+	}
+
+	if config.Latency.Enabled {
+		rtt, err := probeLatency(ip)
+		if err != nil {
+			slog.Debug("Latency probe failed", "account", account.Name, "ip", ip.String(), "error", err)
+		} else {
+			data.LatencyMs = float64(rtt.Microseconds()) / 1000
+		}
+	}
+
+	if config.Detection.Enabled {
+		result := detectCDN(c, data)
+		if result.CDN != "" {
+			data.CdnOrgName = result.CDN
+		}
+		data.Confidence = result.Confidence
+		data.Alternatives = result.Alternatives
+		data.TLSIssuer = result.TLSIssuer
+	}
+
+	stats.observe(data.CdnIp, data.CdnOrgName)
+	stats.served(c.account.Name, data.CustomerHostname, data.CdnOrgName)
+	cdnObservationsTotal.WithLabelValues(data.CdnOrgName).Inc()
+
 	data.CustomerStreamType = streamType
+	data.StreamTypeSource = streamTypeSource
+	data.WebSocket = resourceType == network.ResourceTypeWebSocket
+	data.RequestMethod = method
+	data.ResourceType = string(resourceType)
+	c.noteProvider(data.CustomerHostname, streamType, data.CdnOrgName)
+	if account.RecordMatchedURL {
+		data.MatchedURL = url
+	}
 	data.AccountName = account.Name
 	data.AccountUnit = account.Unit
 	data.AccountID = account.ID
 
-	err = saveData(account, data)
+	if !c.replayTime.IsZero() {
+		data.Timestamp = c.replayTime.In(timestampLocation)
+	}
+
+	data.table = account.DBTableName
+	data.Outcome = outcomeOK
+	data.EmulationProfile = c.account.emulation().profileName()
+	data.Extra = extraColumnValues(account.ExtraColumns, data)
+
+	ttfs, firstRow := c.timeToFirstSegment()
+	if firstRow {
+		data.TimeToFirstSegmentMs = ttfs.Milliseconds()
+	}
+
+	err = sink.Write(data)
 	if err != nil {
-		log.Println("Error saving data:", err)
+		observed.remove(key)
+		stats.error()
+		slog.Error("Error saving data", "account", account.Name, "url", url, "ip", data.CdnIp, "cdn_org", data.CdnOrgName, "error", err)
 		return
 	}
 
-	time.Sleep(time.Duration(account.SleepDuration) * time.Second)
+	if firstRow {
+		c.firstSegmentReported()
+	}
+	c.rows.Add(1)
+	stats.rowWritten()
+	slog.Debug("Saved observation", "account", account.Name, "url", url, "ip", data.CdnIp, "cdn_org", data.CdnOrgName, "stream_type", streamType)
 }
 
-func who(u string) (CdnShareData, error) {
+// hostOf returns the host of u, or "" if it can't be parsed.
+func hostOf(u string) string {
 	parsedURL, err := url.Parse(u)
 	if err != nil {
-		return CdnShareData{}, err
+		return ""
+	}
+	return parsedURL.Host
+}
+
+// resolve returns the host of u and the first IP it resolves to.
+func resolve(u string) (string, net.IP, error) {
+	hostname, ips, err := resolveAll(u)
+	if err != nil {
+		return "", nil, err
+	}
+	return hostname, ips[0], nil
+}
+
+// resolveAll returns the host of u and every IP it resolves to.
+func resolveAll(u string) (string, []net.IP, error) {
+	parsedURL, err := url.Parse(u)
+	if err != nil {
+		return "", nil, err
 	}
 
 	hostname := parsedURL.Host
 
-	ips, err := net.LookupIP(hostname)
+	ips, err := net.LookupIP(parsedURL.Hostname())
 	if err != nil {
-		return CdnShareData{}, err
+		return "", nil, err
+	}
+	return hostname, ips, nil
+}
+
+// resolve resolves u like resolveAll, except that a replayed capture uses
+// the IP its HAR recorded for the host.
+func (c *capture) resolve(u string) (string, []net.IP, error) {
+	if c.replayIPs != nil {
+		if host := hostOf(u); c.replayIPs[host] != nil {
+			return host, []net.IP{c.replayIPs[host]}, nil
+		}
 	}
+	return resolveAll(u)
+}
+
+// detectionMethod returns the account's detection method, falling back to
+// the global default.
+func (a Account) detectionMethod() string {
+	return cmp.Or(a.DetectionMethod, config.Lookup.DetectionMethod)
+}
 
-	ip := ips[0]
+// maxCapturesPerURL returns the account's limit on matched requests per
+// URL, falling back to the global one. Zero means no limit.
+func (a Account) maxCapturesPerURL() int {
+	return cmp.Or(a.MaxCapturesPerURL, config.MaxCapturesPerURL)
+}
+
+// urlConcurrency returns how many of the account's URLs to collect at
+// once, falling back to the global setting.
+func (a Account) urlConcurrency() int {
+	return cmp.Or(a.URLConcurrency, config.URLConcurrency, 1)
+}
+
+// userAgent returns the User-Agent to emulate for the account, or "" to
+// keep Chrome's default.
+func (a Account) userAgent() string {
+	return cmp.Or(a.UserAgent, config.UserAgent)
+}
+
+// captureWindow returns how long to leave a page open: sleepDuration,
+// lengthened but never shortened by jitter. With captureTimeoutSeconds set,
+// jitter adds at most half the time between the two, leaving the rest for
+// navigation, so jitter alone doesn't make captures time out.
+func (a Account) captureWindow() time.Duration {
+	d := time.Duration(a.SleepDuration) * time.Second
+	w := jitterUp(d)
+	if a.CaptureTimeoutSeconds > 0 {
+		timeout := time.Duration(a.CaptureTimeoutSeconds) * time.Second
+		w = min(w, d+(timeout-d)/2)
+	}
+	return w
+}
 
-	if data, ok := whoisCache[ip.String()]; ok {
+// lookupCDNs finds the CDN org for each of ips using the capture's
+// account's detection method. Provider lookups run concurrently through
+// whoAll. It returns the per-IP results in the order of ips and the
+// distinct CDN orgs found.
+func lookupCDNs(c *capture, hostname string, ips []net.IP) ([]ipLookup, []string) {
+	switch method := c.account.detectionMethod(); method {
+	case "headers":
+		results := make([]ipLookup, len(ips))
+		var orgs []string
+		for i, ip := range ips {
+			results[i].IP = ip
+			results[i].Data, results[i].Err = lookupHeaders(c, hostname, ip)
+			if results[i].Err == nil && !slices.Contains(orgs, results[i].Data.CdnOrgName) {
+				orgs = append(orgs, results[i].Data.CdnOrgName)
+			}
+		}
+		return results, orgs
+	case "auto":
+		return whoAll(c.ctx, hostname, ips, config.Lookup.Providers)
+	default:
+		return whoAll(c.ctx, hostname, ips, []string{method})
+	}
+}
+
+// lookupHeaders names the CDN from the response headers seen for hostname.
+// Results are per page, so they are not cached.
+func lookupHeaders(c *capture, hostname string, ip net.IP) (CdnShareData, error) {
+	lookupsTotal.WithLabelValues("headers").Inc()
+	signals := headerSignals(c.headersFor(hostname))
+	if len(signals) == 0 {
+		return CdnShareData{}, fmt.Errorf("no CDN response headers seen for %s", hostname)
+	}
+
+	return CdnShareData{
+		Timestamp:        observationTime(),
+		CdnIp:            ip.String(),
+		CustomerHostname: hostname,
+		CdnOrgName:       fuseSignals(signals).CDN,
+	}, nil
+}
+
+// lookupProviders look up the CDN org for an IP and cache the result.
+var lookupProviders = map[string]func(ctx context.Context, hostname string, ip net.IP) (CdnShareData, error){
+	"ipinfo": lookupIPInfoOrg,
+	"cymru":  lookupCymru,
+	"rdap":   lookupRDAP,
+	"whois": func(ctx context.Context, hostname string, ip net.IP) (CdnShareData, error) {
+		return lookupWhois(ctx, hostname, ip, defaultWhoisFields)
+	},
+}
+
+// who looks up the CDN org for ip with providers, trying each in turn. A
+// cached result from a provider not in the list is ignored.
+func who(ctx context.Context, hostname string, ip net.IP, providers []string) (CdnShareData, error) {
+	if data, ok := cacheGet(ip); ok && (data.Provider == "" || slices.Contains(providers, data.Provider)) {
+		stats.cacheHit()
+		cacheHitsTotal.Inc()
+		slog.Debug("WHOIS cache hit", "hostname", hostname, "ip", ip.String(), "cdn_org", data.CdnOrgName)
 		return CdnShareData{
-			Timestamp:        time.Now(),
+			Timestamp:        observationTime(),
 			CdnIp:            ip.String(),
 			CustomerHostname: hostname,
 			CdnOrgName:       prettyCdnOrgName(data.CdnOrgName),
 			ParsedWhois:      data.ParsedWhois,
+			Prefix:           data.Prefix,
+			ipinfo:           data.IPInfo,
 		}, nil
 	}
 
-	// Create a new client for the ipinfo package.
-	client := ipinfo.NewClient(nil, nil, IPINFO_TOKEN)
-
-	info, err := client.GetIPInfo(ip)
-	if err != nil {
-		return CdnShareData{}, err
+	// Results depend on the providers, so failures are remembered per list.
+	failedKey := ip.String() + " " + strings.Join(providers, ",")
+	if failedLookups.failed(failedKey) {
+		return CdnShareData{}, errRecentlyFailed
 	}
 
-	cdnOrgName, _ := client.GetIPOrg(ip)
-	prettyName := prettyCdnOrgName(cdnOrgName)
+	stats.cacheMiss()
+	cacheMissesTotal.Inc()
 
-	whoisCache[ip.String()] = WhoisCacheData{
-		Timestamp:   time.Now(),
-		CdnOrgName:  prettyName,
-		ParsedWhois: info.Org,
+	// Concurrent misses for the same IP, from hostnames sharing an edge or
+	// a multi-IP fan-out, wait for one lookup instead of repeating it. A
+	// lookup cut short by its caller's context is retried under ours.
+	for {
+		data, err, shared := lookupFlights.do(failedKey, func() (CdnShareData, error) {
+			return lookupUncached(ctx, hostname, ip, providers, failedKey)
+		})
+		if shared && isContextError(err) && ctx.Err() == nil {
+			continue
+		}
+		if shared && err == nil {
+			data.CustomerHostname = hostname
+		}
+		return data, err
 	}
-	return CdnShareData{
-		Timestamp:        time.Now(),
-		CdnIp:            ip.String(),
-		CustomerHostname: hostname,
-		CdnOrgName:       prettyName,
-		ParsedWhois:      info.Org,
-	}, nil
 }
 
-func who2(u string, expectedFields []string) (CdnShareData, error) {
-	parsedURL, err := url.Parse(u)
-	if err != nil {
-		return CdnShareData{}, err
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// lookupUncached tries each of providers in turn for ip, and remembers a
+// total failure under failedKey.
+func lookupUncached(ctx context.Context, hostname string, ip net.IP, providers []string, failedKey string) (CdnShareData, error) {
+	var errs []error
+	for _, provider := range providers {
+		breaker := providerBreaker(provider)
+		if !breaker.allow() {
+			errs = append(errs, fmt.Errorf("%s: %w", provider, errCircuitOpen))
+			continue
+		}
+		if !lookups.take() {
+			breaker.abandon()
+			return CdnShareData{}, errBudgetExceeded
+		}
+		data, err := lookupProviders[provider](ctx, hostname, ip)
+		if ctx.Err() != nil {
+			// The caller gave up, which says nothing about the provider or
+			// the IP, so neither the breaker nor the negative cache learn
+			// from it.
+			breaker.abandon()
+			return CdnShareData{}, ctx.Err()
+		}
+		breaker.record(err)
+		if err == nil {
+			return data, nil
+		}
+		slog.Warn("CDN org lookup failed", "provider", provider, "hostname", hostname, "ip", ip.String(), "error", err)
+		errs = append(errs, fmt.Errorf("%s: %w", provider, err))
 	}
 
-	hostname := parsedURL.Host
+	failedLookups.add(failedKey, time.Duration(config.Cache.NegativeTTLSeconds)*time.Second)
+	return CdnShareData{}, errors.Join(errs...)
+}
 
-	ips, err := net.LookupIP(hostname)
-	if err != nil {
+// lookupWhois queries WHOIS for ip and caches the result.
+func lookupWhois(ctx context.Context, hostname string, ip net.IP, expectedFields []string) (CdnShareData, error) {
+	if err := lookupLimiter.Wait(ctx); err != nil {
 		return CdnShareData{}, err
 	}
 
-	ip := ips[0]
-
-	if data, ok := whoisCache[ip.String()]; ok {
-		return CdnShareData{
-			Timestamp:        time.Now(),
-			CdnIp:            ip.String(),
-			CustomerHostname: hostname,
-			CdnOrgName:       data.CdnOrgName,
-			ParsedWhois:      data.ParsedWhois,
-		}, nil
+	// An override in lookup.whoisServers wins. Otherwise, with
+	// per-registry limits, query the registry's server directly so the
+	// limit applies to the server actually hit.
+	var servers []string
+	var limiter *rateLimiter
+	if server := whoisServerOverride(hostname, ip); server != "" {
+		servers = append(servers, server)
+		if len(config.Lookup.WhoisRIRRequestsPerSecond) > 0 {
+			limiter = rirLimiter(rirDefault)
+		}
+	} else if len(config.Lookup.WhoisRIRRequestsPerSecond) > 0 {
+		rir := whoisRIR(ctx, ip)
+		limiter = rirLimiter(rir)
+		if server, ok := rirWhoisServers[rir]; ok {
+			servers = append(servers, server)
+		}
 	}
 
-	whoisResult, err := whois.Whois(ip.String())
+	var whoisResult string
+	err := retry(ctx, config.Lookup.WhoisRetry, whoisRetryable, func() error {
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+		lookupsTotal.WithLabelValues("whois").Inc()
+		var err error
+		whoisResult, err = whoisQuery(ctx, ip.String(), servers)
+		return err
+	})
 	if err != nil {
 		return CdnShareData{}, err
 	}
 
 	cdnOrgName := parseWhois(whoisResult, expectedFields)
 	prettyName := prettyCdnOrgName(cdnOrgName)
+	prefix := whoisPrefix(whoisResult, ip)
 
-	whoisCache[ip.String()] = WhoisCacheData{
+	cachePut(ip, WhoisCacheData{
 		Timestamp:   time.Now(),
 		CdnOrgName:  prettyName,
 		ParsedWhois: whoisResult,
-	}
+		Prefix:      prefix,
+		Provider:    "whois",
+	})
+	slog.Debug("Looked up CDN org", "provider", "whois", "hostname", hostname, "ip", ip.String(), "cdn_org", prettyName)
 	return CdnShareData{
-		Timestamp:        time.Now(),
+		Timestamp:        observationTime(),
 		CdnIp:            ip.String(),
 		CustomerHostname: hostname,
 		CdnOrgName:       prettyName,
 		ParsedWhois:      whoisResult,
+		Prefix:           prefix,
 	}, nil
 }
 
+// whoisClient is the WHOIS client, whose timeout NewCollector sets from
+// lookup.whoisTimeoutSeconds.
+var whoisClient = whois.NewClient()
+
+// whoisQuery runs a WHOIS query that gives up after
+// lookup.whoisTimeoutSeconds or when ctx ends. The client has no context
+// support, so an abandoned query finishes in the background, bounded by the
+// client's own timeout.
+func whoisQuery(ctx context.Context, query string, servers []string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(config.Lookup.WhoisTimeoutSeconds)*time.Second)
+	defer cancel()
+
+	type result struct {
+		text string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		text, err := whoisClient.Whois(query, servers...)
+		done <- result{text, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.text, r.err
+	case <-ctx.Done():
+		return "", fmt.Errorf("whois query for %s: %w", query, ctx.Err())
+	}
+}
+
 func parseWhois(whoisResult string, expectedFields []string) string {
 	lines := strings.Split(whoisResult, "\n")
 	for _, line := range lines {
@@ -324,21 +1589,168 @@ func saveData(account Account, data CdnShareData) error {
 	return err
 }**/
 
-func saveData(account Account, data CdnShareData) error {
+// nullFloat and nullInt store an unset (zero) measurement as NULL.
+func nullFloat(v float64) sql.NullFloat64 {
+	return sql.NullFloat64{Float64: v, Valid: v != 0}
+}
+
+func nullInt(v int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: v, Valid: v != 0}
+}
+
+func saveData(db *sql.DB, tableName string, data CdnShareData) error {
 	// Ensure the table exists before trying to insert data.
-	err := ensureTableExists(account.DBTableName)
+	err := ensureTableExists(db, tableName, observationSchema())
 	if err != nil {
+		dbInsertErrorsTotal.Inc()
 		return fmt.Errorf("error ensuring table exists: %w", err)
 	}
 
-	query := fmt.Sprintf(`INSERT INTO %s (timestamp, cdn_ip, hostname, cdn_orgname, stream_type, account_name, account_unit, account_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, account.DBTableName)
+	err = migrateTable(db, tableName, slices.Concat(observationColumns, extraTableColumns(tableName, data.Extra)), observationIndexes)
+	if err != nil {
+		dbInsertErrorsTotal.Inc()
+		return fmt.Errorf("error migrating table: %w", err)
+	}
 
-	_, err = db.Exec(query, data.Timestamp, data.CdnIp, data.CustomerHostname, data.CdnOrgName, data.CustomerStreamType, data.AccountName, data.AccountUnit, data.AccountID)
-	return err
+	// timestamp is when the observation was made; created_at and updated_at
+	// are bookkeeping for when the row was written and last changed. Every
+	// observation is a new row, so nothing is upserted: updated_at starts
+	// out equal to created_at and only moves if the row is edited later.
+	now := time.Now()
+	columns := `timestamp, cdn_ip, hostname, cdn_orgname, stream_type, account_name, account_unit, account_id, prefix, created_at, updated_at, outcome, emulation_profile, request_method, resource_type, cdn_providers, multi_cdn, matched_url, websocket, latency_ms, time_to_first_segment_ms, stream_type_source, confidence, alternatives, tls_issuer`
+	args := []any{data.Timestamp, data.CdnIp, data.CustomerHostname, data.CdnOrgName, data.CustomerStreamType, data.AccountName, data.AccountUnit, data.AccountID, data.Prefix, now, now, data.Outcome, data.EmulationProfile, data.RequestMethod, data.ResourceType, data.CdnProviders, data.MultiCDN, data.MatchedURL, data.WebSocket, nullFloat(data.LatencyMs), nullInt(data.TimeToFirstSegmentMs), data.StreamTypeSource, nullFloat(data.Confidence), candidatesJSON(data.Alternatives), data.TLSIssuer}
+	for _, column := range slices.Sorted(maps.Keys(data.Extra)) {
+		columns += `, "` + column + `"`
+		args = append(args, data.Extra[column])
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ")
+	query := fmt.Sprintf(`INSERT INTO %s (%s) VALUES (%s)`, tableName, columns, placeholders)
+
+	stmt, err := insertStmt(db, query)
+	if err != nil {
+		dbInsertErrorsTotal.Inc()
+		return fmt.Errorf("error preparing insert: %w", err)
+	}
+	_, err = stmt.Exec(args...)
+	if err != nil {
+		dbInsertErrorsTotal.Inc()
+		return err
+	}
+
+	dbInsertsTotal.Inc()
+	return nil
+}
+
+// insertStmts caches a prepared statement per database handle and INSERT
+// query, that is per table and set of extra columns, so the server parses
+// each only once.
+var insertStmts sync.Map
+
+// insertStmtKey keys insertStmts. A statement belongs to the handle that
+// prepared it, so each handle's are kept and closed apart.
+type insertStmtKey struct {
+	db    *sql.DB
+	query string
+}
+
+// insertStmt returns the prepared statement for query on db, preparing it on
+// first use.
+func insertStmt(db *sql.DB, query string) (*sql.Stmt, error) {
+	key := insertStmtKey{db, query}
+	if stmt, ok := insertStmts.Load(key); ok {
+		return stmt.(*sql.Stmt), nil
+	}
+
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	if prev, loaded := insertStmts.LoadOrStore(key, stmt); loaded {
+		stmt.Close()
+		return prev.(*sql.Stmt), nil
+	}
+	return stmt, nil
+}
+
+// closeInsertStmts closes and forgets the prepared INSERT statements on db.
+func closeInsertStmts(db *sql.DB) {
+	insertStmts.Range(func(key, stmt any) bool {
+		if key.(insertStmtKey).db == db {
+			stmt.(*sql.Stmt).Close()
+			insertStmts.Delete(key)
+		}
+		return true
+	})
 }
 
-// New function to ensure the table exists.
-func ensureTableExists(tableName string) error {
+// observationTableSchema is the CREATE TABLE statement for account tables.
+const observationTableSchema = `CREATE TABLE %s (
+	"id" bigint(11) NOT NULL AUTO_INCREMENT,
+	"timestamp" datetime DEFAULT NULL,
+	"cdn_ip" text CHARACTER SET utf8 COLLATE utf8_general_ci,
+	"hostname" varchar(255) CHARACTER SET utf8 COLLATE utf8_general_ci DEFAULT NULL,
+	"cdn_orgname" varchar(255) CHARACTER SET utf8 COLLATE utf8_general_ci DEFAULT NULL,
+	"stream_type" enum('live','ondemand') CHARACTER SET utf8 COLLATE utf8_general_ci DEFAULT NULL,
+	"account_name" varchar(255) CHARACTER SET utf8 COLLATE utf8_general_ci NOT NULL,
+	"account_unit" varchar(255) CHARACTER SET utf8 COLLATE utf8_general_ci NOT NULL,
+	"account_id" varchar(255) CHARACTER SET utf8 COLLATE utf8_general_ci NOT NULL,
+	"prefix" ` + prefixColumn + `,
+	"created_at" ` + createdAtColumn + `,
+	"updated_at" ` + updatedAtColumn + `,
+	"outcome" ` + outcomeColumn + `,
+	"emulation_profile" ` + emulationProfileColumn + `,
+	"request_method" ` + requestMethodColumn + `,
+	"resource_type" ` + resourceTypeColumn + `,
+	"cdn_providers" ` + cdnProvidersColumn + `,
+	"multi_cdn" ` + multiCDNColumn + `,
+	"matched_url" ` + matchedURLColumn + `,
+	"websocket" ` + webSocketColumn + `,
+	"latency_ms" ` + latencyMsColumn + `,
+	"time_to_first_segment_ms" ` + timeToFirstSegmentColumn + `,
+	"stream_type_source" ` + streamTypeSourceColumn + `,
+	"confidence" ` + confidenceColumn + `,
+	"alternatives" ` + alternativesColumn + `,
+	"tls_issuer" ` + tlsIssuerColumn + `,
+	UNIQUE KEY "PRIMARY" ("id") USING HASH,
+	KEY "` + hostnameIndex + `" ` + hostnameIndexColumns + ` USING HASH,
+	SHARD KEY "__SHARDKEY" ("id"),
+	` + unorderedColumnstoreKey + `
+) AUTO_INCREMENT=1 AUTOSTATS_CARDINALITY_MODE=INCREMENTAL AUTOSTATS_HISTOGRAM_MODE=CREATE AUTOSTATS_SAMPLING=ON SQL_MODE='STRICT_ALL_TABLES'`
+
+// The columnstore key of account tables: unordered by default, or sorted by
+// timestamp with database.partitioning set to "date".
+const (
+	unorderedColumnstoreKey = `KEY "__UNORDERED" () USING CLUSTERED COLUMNSTORE`
+	timestampSortKey        = `SORT KEY ("timestamp")`
+)
+
+// observationSchema returns the CREATE TABLE format string for new account
+// tables. SingleStore has no RANGE partitioning; instead, date partitioning
+// sorts the columnstore by timestamp, so each segment covers a time range
+// and queries and retention deletes by date skip the segments outside it.
+func observationSchema() string {
+	if config.Database.Partitioning == "date" {
+		return strings.Replace(observationTableSchema, unorderedColumnstoreKey, timestampSortKey, 1)
+	}
+	return observationTableSchema
+}
+
+// ensureTableExists creates tableName from schema, a CREATE TABLE format
+// string taking the table name, if it does not exist yet.
+func ensureTableExists(db *sql.DB, tableName string, schema string) error {
+	if _, ok := knownTables.Load(tableName); ok {
+		return nil
+	}
+
+	// Concurrent first inserts into a table wait for one check rather than
+	// all querying information_schema.
+	mu, _ := tableChecks.LoadOrStore(tableName, new(sync.Mutex))
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+	if _, ok := knownTables.Load(tableName); ok {
+		return nil
+	}
+
 	// Check if the table exists.
 	var exists bool
 	query := `
@@ -355,62 +1767,65 @@ func ensureTableExists(tableName string) error {
 
 	// If the table does not exist, create it.
 	if !exists {
-		_, err = db.Exec(fmt.Sprintf(`CREATE TABLE %s (
-			"id" bigint(11) NOT NULL AUTO_INCREMENT,
-			"timestamp" datetime DEFAULT NULL,
-			"cdn_ip" text CHARACTER SET utf8 COLLATE utf8_general_ci,
-			"hostname" varchar(255) CHARACTER SET utf8 COLLATE utf8_general_ci DEFAULT NULL,
-			"cdn_orgname" varchar(255) CHARACTER SET utf8 COLLATE utf8_general_ci DEFAULT NULL,
-			"stream_type" enum('live','ondemand') CHARACTER SET utf8 COLLATE utf8_general_ci DEFAULT NULL,
-			"account_name" varchar(255) CHARACTER SET utf8 COLLATE utf8_general_ci NOT NULL,
-			"account_unit" varchar(255) CHARACTER SET utf8 COLLATE utf8_general_ci NOT NULL,
-			"account_id" varchar(255) CHARACTER SET utf8 COLLATE utf8_general_ci NOT NULL,
-			UNIQUE KEY "PRIMARY" ("id") USING HASH,
-			SHARD KEY "__SHARDKEY" ("id"),
-			KEY "__UNORDERED" () USING CLUSTERED COLUMNSTORE
-		  ) AUTO_INCREMENT=1 AUTOSTATS_CARDINALITY_MODE=INCREMENTAL AUTOSTATS_HISTOGRAM_MODE=CREATE AUTOSTATS_SAMPLING=ON SQL_MODE='STRICT_ALL_TABLES'`, tableName))
+		_, err = db.Exec(fmt.Sprintf(schema, tableName))
+		if err != nil {
+			return err
+		}
 	}
 
-	return err
+	knownTables.Store(tableName, true)
+	return nil
 }
 
-func loadCache() error {
-	cacheData, err := os.ReadFile(cacheFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			// If the cache file does not exist yet, that's fine
-			return nil
-		}
-		return err
-	}
+// knownTables records tables ensureTableExists has found or created, which
+// are then assumed to exist for the rest of the process. tableChecks holds
+// a mutex per table serializing the checks.
+var knownTables, tableChecks sync.Map
 
-	dec := gob.NewDecoder(strings.NewReader(string(cacheData)))
-	return dec.Decode(&whoisCache)
+type PrettyNameMapping struct {
+	Pattern    string `json:"pattern"`
+	PrettyName string `json:"prettyName"`
+	// Match is "substring" (the default), where Pattern must appear in the
+	// org name, or "glob", where the whole org name must match Pattern
+	// with * and ? wildcards, as in "Amazon*".
+	Match string `json:"match"`
 }
 
-func saveCache() error {
-	var b strings.Builder
-	enc := gob.NewEncoder(&b)
-
-	err := enc.Encode(whoisCache)
-	if err != nil {
-		return err
+func (m PrettyNameMapping) matches(cdnOrgName string) bool {
+	if m.Match == "glob" {
+		ok, _ := path.Match(m.Pattern, cdnOrgName)
+		return ok
 	}
-
-	return os.WriteFile(cacheFile, []byte(b.String()), 0666)
+	return strings.Contains(cdnOrgName, m.Pattern)
 }
 
-type PrettyNameMapping struct {
-	Pattern    string
-	PrettyName string
+// validate checks Match and, for globs, the pattern syntax.
+func (m PrettyNameMapping) validate() error {
+	switch m.Match {
+	case "", "substring":
+	case "glob":
+		if _, err := path.Match(m.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid glob %q: %w", m.Pattern, err)
+		}
+	default:
+		return fmt.Errorf("unknown match %q", m.Match)
+	}
+	if m.Pattern == "" || m.PrettyName == "" {
+		return errors.New("pattern and prettyName are required")
+	}
+	return nil
 }
 
 func prettyCdnOrgName(cdnOrgName string) string {
-	for _, mapping := range cdnOrgNameMappings {
-		if strings.Contains(cdnOrgName, mapping.Pattern) {
+	names := currentOrgNames()
+	for _, mapping := range slices.Concat(names.Mappings, cdnOrgNameMappings) {
+		if mapping.matches(cdnOrgName) {
 			return strings.TrimSpace(mapping.PrettyName)
 		}
 	}
+	if names.Normalize {
+		return fuzzyPrettyName(cdnOrgName, names)
+	}
 	// If no pretty name is found, return the original cdnOrgName
 	return strings.TrimSpace(cdnOrgName)
 }
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chromedp/cdproto/network"
+)
+
+func TestRecordObservationWritesRow(t *testing.T) {
+	prevSink, prevObserved := sink, observed
+	t.Cleanup(func() { sink, observed = prevSink, prevObserved })
+
+	mem := new(memorySink)
+	sink = mem
+	observed = newDedupSet("")
+
+	c := &capture{account: Account{Name: "example", Unit: "video", ID: "42", DBTableName: "cdn_example"}}
+	r := ipLookup{
+		IP: net.ParseIP("192.0.2.10"),
+		Data: CdnShareData{
+			CdnIp:            "192.0.2.10",
+			CustomerHostname: "cdn.example.com",
+			CdnOrgName:       "Example CDN",
+		},
+	}
+	recordObservation(c, "https://cdn.example.com/live/index.m3u8", "key", r, "GET", network.ResourceTypeXHR, "hls", "manifest")
+
+	rows := mem.Rows()
+	if len(rows) != 1 {
+		t.Fatalf("%d rows written, want 1", len(rows))
+	}
+	got := rows[0]
+	if got.AccountName != "example" || got.AccountUnit != "video" || got.AccountID != "42" {
+		t.Errorf("account = %q/%q/%q, want example/video/42", got.AccountName, got.AccountUnit, got.AccountID)
+	}
+	if got.CustomerStreamType != "hls" || got.StreamTypeSource != "manifest" {
+		t.Errorf("stream type = %q from %q, want hls from manifest", got.CustomerStreamType, got.StreamTypeSource)
+	}
+	if got.CdnProviders != "" || got.MultiCDN {
+		t.Errorf("observation carries providers %q, multi-CDN %v, want them left to the providers row", got.CdnProviders, got.MultiCDN)
+	}
+	if got.Outcome != outcomeOK || got.table != "cdn_example" {
+		t.Errorf("outcome %q into %q, want %q into cdn_example", got.Outcome, got.table, outcomeOK)
+	}
+	if c.rows.Load() != 1 {
+		t.Errorf("capture counted %d rows, want 1", c.rows.Load())
+	}
+}
+
+// cappedCapture returns a capture already at its maxCapturesPerURL, so
+// processMatch counts each match as capped without looking it up.
+func cappedCapture(ctx context.Context) *capture {
+	c := &capture{account: Account{Name: "example", MaxCapturesPerURL: 1}, ctx: ctx}
+	c.captures.Store(1)
+	return c
+}
+
+func TestMatchWorkerProcessesQueuedMatches(t *testing.T) {
+	c := cappedCapture(context.Background())
+	stop := c.startMatchWorker()
+	for range 3 {
+		c.queueMatch("https://cdn.example.com/seg.ts", "GET", network.ResourceTypeMedia)
+	}
+	stop()
+
+	if n := c.capped.Load(); n != 3 {
+		t.Errorf("%d matches processed, want 3", n)
+	}
+
+	// Matches arriving after the worker stopped are ignored rather than
+	// blocking the event listener.
+	for range matchQueueSize + 1 {
+		c.queueMatch("https://cdn.example.com/seg.ts", "GET", network.ResourceTypeMedia)
+	}
+}
+
+func TestMatchWorkerDropsMatchesAfterRunEnds(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := cappedCapture(ctx)
+	stop := c.startMatchWorker()
+	cancel()
+	c.queueMatch("https://cdn.example.com/seg.ts", "GET", network.ResourceTypeMedia)
+	stop()
+
+	if n := c.capped.Load(); n != 0 {
+		t.Errorf("%d matches processed after the run ended, want 0", n)
+	}
+}
+
+func TestQueueMatchWithoutWorkerIsInline(t *testing.T) {
+	c := cappedCapture(context.Background())
+	c.queueMatch("https://cdn.example.com/seg.ts", "GET", network.ResourceTypeMedia)
+
+	if n := c.capped.Load(); n != 1 {
+		t.Errorf("%d matches processed, want 1 processed inline", n)
+	}
+}
+
+func TestReportMultiCDNWritesFinalProviders(t *testing.T) {
+	prevSink := sink
+	t.Cleanup(func() { sink = prevSink })
+	mem := new(memorySink)
+	sink = mem
+
+	c := &capture{account: Account{Name: "example", DBTableName: "cdn_example"}}
+	// The order the orgs arrive in must not matter.
+	c.noteProvider("cdn.example.com", "live", "Fastly")
+	c.noteProvider("cdn.example.com", "live", "Akamai")
+	c.noteProvider("cdn.example.com", "live", "Fastly")
+	c.noteProvider("img.example.com", "live", "Akamai")
+	c.reportMultiCDN()
+
+	rows := mem.Rows()
+	if len(rows) != 2 {
+		t.Fatalf("%d providers rows, want 2", len(rows))
+	}
+	want := []struct {
+		hostname  string
+		providers string
+		multi     bool
+	}{
+		{"cdn.example.com", "Akamai,Fastly", true},
+		{"img.example.com", "Akamai", false},
+	}
+	for i, w := range want {
+		got := rows[i]
+		if got.Outcome != outcomeProviders || got.CustomerHostname != w.hostname || got.CdnProviders != w.providers || got.MultiCDN != w.multi {
+			t.Errorf("row %d = %s %s %q multi=%v, want %s %s %q multi=%v", i, got.Outcome, got.CustomerHostname, got.CdnProviders, got.MultiCDN, outcomeProviders, w.hostname, w.providers, w.multi)
+		}
+	}
+}
+
+func TestConfigWatcherAppliesOrgNames(t *testing.T) {
+	t.Cleanup(func() { orgNames.Store(nil) })
+
+	orgNames.Store(&OrgNamesConfig{})
+	if got := prettyCdnOrgName("Example Edge Networks"); got != "Example Edge Networks" {
+		t.Fatalf("prettyCdnOrgName() = %q before reload, want the org unchanged", got)
+	}
+
+	prevAccounts, prevRules := config.Accounts, fingerprints.Load()
+	t.Cleanup(func() {
+		config.Accounts = prevAccounts
+		fingerprints.Store(prevRules)
+	})
+	w := &configWatcher{path: filepath.Join(t.TempDir(), "missing.json")}
+	w.pending.Store(&reloadedConfig{orgNames: OrgNamesConfig{
+		Mappings: []PrettyNameMapping{{Pattern: "Example Edge", PrettyName: "Example CDN"}},
+	}})
+	w.apply()
+	if got := prettyCdnOrgName("Example Edge Networks"); got != "Example CDN" {
+		t.Errorf("prettyCdnOrgName() = %q after reload, want %q", got, "Example CDN")
+	}
+}
+
+func TestCaptureWindowOnlyLengthens(t *testing.T) {
+	prev := config
+	t.Cleanup(func() { config = prev })
+	config.JitterPercent = 100
+
+	a := Account{SleepDuration: 10, CaptureTimeoutSeconds: 14}
+	for range 100 {
+		if w := a.captureWindow(); w < 10*time.Second || w > 12*time.Second {
+			t.Fatalf("captureWindow() = %v, want between 10s and 12s", w)
+		}
+	}
+}
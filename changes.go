@@ -0,0 +1,94 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const cdnChangesTable = "cdn_changes"
+
+const cdnChangesTableSchema = `CREATE TABLE %s (
+	"id" bigint(11) NOT NULL AUTO_INCREMENT,
+	"timestamp" datetime DEFAULT NULL,
+	"account_name" varchar(255) CHARACTER SET utf8 COLLATE utf8_general_ci NOT NULL,
+	"account_id" varchar(255) CHARACTER SET utf8 COLLATE utf8_general_ci NOT NULL,
+	"hostname" varchar(255) CHARACTER SET utf8 COLLATE utf8_general_ci DEFAULT NULL,
+	"stream_type" enum('live','ondemand') CHARACTER SET utf8 COLLATE utf8_general_ci DEFAULT NULL,
+	"old_cdn_orgname" varchar(255) CHARACTER SET utf8 COLLATE utf8_general_ci DEFAULT NULL,
+	"new_cdn_orgname" varchar(255) CHARACTER SET utf8 COLLATE utf8_general_ci DEFAULT NULL,
+	UNIQUE KEY "PRIMARY" ("id") USING HASH,
+	SHARD KEY "__SHARDKEY" ("id"),
+	KEY "__UNORDERED" () USING CLUSTERED COLUMNSTORE
+) AUTO_INCREMENT=1 AUTOSTATS_CARDINALITY_MODE=INCREMENTAL AUTOSTATS_HISTOGRAM_MODE=CREATE AUTOSTATS_SAMPLING=ON SQL_MODE='STRICT_ALL_TABLES'`
+
+// CDNChange records a hostname moving from one set of CDN orgs to another,
+// each a sorted, comma-separated list as in cdn_providers.
+type CDNChange struct {
+	Timestamp   time.Time `json:"timestamp"`
+	AccountName string    `json:"account_name"`
+	AccountID   string    `json:"account_id"`
+	Hostname    string    `json:"hostname"`
+	StreamType  string    `json:"stream_type"`
+	OldCdnOrg   string    `json:"old_cdn_orgname"`
+	NewCdnOrg   string    `json:"new_cdn_orgname"`
+}
+
+// detectCDNChange compares the CDN orgs of a capture's providers row with
+// those of the last providers row in tableName for the same account,
+// hostname and stream type, and records a row in cdn_changes when the sets
+// differ. Comparing whole captures rather than single observations keeps a
+// hostname load-balanced across CDNs from flipping on every row. Other rows
+// are ignored. It must run before data is inserted.
+func detectCDNChange(db *sql.DB, tableName string, data CdnShareData) error {
+	if data.Outcome != outcomeProviders {
+		return nil
+	}
+
+	query := fmt.Sprintf(`SELECT cdn_providers FROM %s WHERE account_id = ? AND hostname = ? AND stream_type = ? AND outcome = '%s' ORDER BY timestamp DESC LIMIT 1`, tableName, outcomeProviders)
+
+	var previous sql.NullString
+	err := db.QueryRow(query, data.AccountID, data.CustomerHostname, data.CustomerStreamType).Scan(&previous)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !previous.Valid || previous.String == data.CdnProviders {
+		return nil
+	}
+
+	change := CDNChange{
+		Timestamp:   data.Timestamp,
+		AccountName: data.AccountName,
+		AccountID:   data.AccountID,
+		Hostname:    data.CustomerHostname,
+		StreamType:  data.CustomerStreamType,
+		OldCdnOrg:   previous.String,
+		NewCdnOrg:   data.CdnProviders,
+	}
+
+	if err := saveCDNChange(db, change); err != nil {
+		return err
+	}
+
+	slog.Info("CDN change detected", "account", change.AccountName, "hostname", change.Hostname, "stream_type", change.StreamType, "old_cdn_org", change.OldCdnOrg, "new_cdn_org", change.NewCdnOrg)
+	notifyCDNChange(change)
+	return nil
+}
+
+func saveCDNChange(db *sql.DB, change CDNChange) error {
+	err := ensureTableExists(db, cdnChangesTable, cdnChangesTableSchema)
+	if err != nil {
+		return fmt.Errorf("error ensuring table exists: %w", err)
+	}
+
+	query := fmt.Sprintf(`INSERT INTO %s (timestamp, account_name, account_id, hostname, stream_type, old_cdn_orgname, new_cdn_orgname) VALUES (?, ?, ?, ?, ?, ?, ?)`, cdnChangesTable)
+
+	_, err = db.Exec(query, change.Timestamp, change.AccountName, change.AccountID, change.Hostname, change.StreamType, change.OldCdnOrg, change.NewCdnOrg)
+	return err
+}
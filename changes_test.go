@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDetectCDNChangeComparesProvidersRows(t *testing.T) {
+	conn, f := openFakeDB(t)
+	table := fmt.Sprintf("changes_providers_%d", time.Now().UnixNano())
+
+	// Observations and status rows are never compared, so a hostname
+	// alternating between CDNs doesn't flip on every row.
+	for _, outcome := range []string{outcomeOK, outcomeNoMedia} {
+		data := testObservation(table)
+		data.Outcome = outcome
+		if err := detectCDNChange(conn, table, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := f.count("SELECT cdn_providers"); n != 0 {
+		t.Errorf("observation and status rows looked up previous providers %d times, want 0", n)
+	}
+
+	data := testObservation(table)
+	data.Outcome = outcomeProviders
+	data.CdnProviders = "Akamai,Fastly"
+	if err := detectCDNChange(conn, table, data); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.count("outcome = '" + outcomeProviders + "'"); n != 1 {
+		t.Errorf("previous providers looked up %d times, want 1", n)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/likexian/whois"
+)
+
+// Collector runs collections with a given config and sink. NewCollector
+// does all the wiring runCollect used to do by hand, so main only parses
+// flags, opens outputs and reports results, and another entry point (or a
+// test with a memorySink) can drive a run the same way.
+//
+// Collector is only an entry point, not an embeddable core: cdnshare is
+// still package main, and the pipeline below Collector reads the
+// package-level config, database handle, cache, counters, limiters and
+// breakers that NewCollector installs. Moving that state into Collector,
+// and the code into an importable package, is left for later, so only one
+// Collector can be created per process.
+type Collector struct {
+	sink Sink
+}
+
+// collectorCreated enforces one Collector per process.
+var collectorCreated atomic.Bool
+
+// NewCollector installs cfg and s, and loads the lookup cache and the
+// incremental state. It fails if a Collector was already created.
+func NewCollector(cfg Config, s Sink) (*Collector, error) {
+	if !collectorCreated.CompareAndSwap(false, true) {
+		return nil, errors.New("a collector already exists in this process")
+	}
+	config = cfg
+	sink = s
+
+	rules, err := compileFingerprintRules(config.Detection.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("error compiling detection rules: %w", err)
+	}
+	fingerprints.Store(&rules)
+	names := config.OrgNames
+	orgNames.Store(&names)
+
+	warnSharedTableColumns(config.Accounts)
+
+	lookupLimiter = newRateLimiter(config.Lookup.RequestsPerSecond)
+
+	tokens := config.IPInfo.Tokens
+	if config.IPInfo.Token != "" {
+		tokens = append([]string{config.IPInfo.Token}, tokens...)
+	}
+	ipinfoTokens = newTokenPool(tokens)
+
+	browserSlots = newBrowserSlots(config.MaxBrowsers)
+	whoisClient = whois.NewClient().SetTimeout(time.Duration(config.Lookup.WhoisTimeoutSeconds) * time.Second)
+
+	whoisCache = newWhoisLRU(config.Cache.MaxEntries)
+	cacheFile = cachePath()
+	if err := loadCache(); err != nil {
+		return nil, fmt.Errorf("error loading cache %s: %w", cacheFile, err)
+	}
+	cacheLoaded.Store(true)
+
+	incremental, err = loadIncrementalState(config.Incremental.StateFile, time.Duration(config.Incremental.MaxAgeSeconds)*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("error loading incremental state %s: %w", config.Incremental.StateFile, err)
+	}
+
+	resumeMaxAge := time.Duration(config.Resume.MaxAgeSeconds) * time.Second
+	if dryRun {
+		resumeMaxAge = 0
+	}
+	resume, err = loadResumeState(config.Resume.StateFile, resumeMaxAge)
+	if err != nil {
+		return nil, fmt.Errorf("error loading resume state %s: %w", config.Resume.StateFile, err)
+	}
+
+	return &Collector{sink: s}, nil
+}
+
+// Run collects every account once, until done or ctx ends, then applies
+// retention and saves the cache and incremental state. Counters and
+// deduplication start afresh for every run. The error is only for failures
+// to save state; collection errors are counted in the summary.
+func (c *Collector) Run(ctx context.Context) (RunSummary, error) {
+	stats.reset()
+	observed = newDedupSet(config.Dedup.Scope)
+	lookups = newLookupBudget(config.Lookup.MaxLookups)
+
+	estimate := estimateLookups(ctx, config.Accounts)
+	printLookupEstimate(os.Stderr, estimate)
+
+	var p *progress
+	if showProgress {
+		p = startProgress(config.Accounts)
+	}
+
+	if config.Cache.FlushIntervalSeconds > 0 && !dryRun {
+		stopFlushing := flushCachePeriodically(time.Duration(config.Cache.FlushIntervalSeconds) * time.Second)
+		defer stopFlushing()
+	}
+
+	accounts := config.Accounts
+	if config.Shuffle.Enabled {
+		accounts = shuffleAccounts(accounts, config.Shuffle.Seed)
+	}
+
+	var wg sync.WaitGroup
+	for _, account := range accounts {
+		wg.Add(1)
+		go func(account Account) {
+			defer wg.Done()
+			if p != nil {
+				defer p.accountDone()
+			}
+			if resume.accountFresh(account.Name) {
+				slog.Info("Skipping recently completed account", "account", account.Name)
+				return
+			}
+			collectAccountURLs(ctx, account)
+			if ctx.Err() != nil {
+				return
+			}
+			// Only a pass over every stream type completes the account.
+			if len(streamTypes) > 0 {
+				return
+			}
+			if err := resume.accountDone(account.Name); err != nil {
+				slog.Warn("Error saving resume state", "path", resume.path, "error", err)
+			}
+		}(account)
+	}
+	wg.Wait()
+	if p != nil {
+		p.finish()
+	}
+	notifications.Wait()
+
+	if config.Retention.MaxAgeDays > 0 && db != nil && !dryRun {
+		err := purgeOldRows(config.Accounts, time.Duration(config.Retention.MaxAgeDays)*24*time.Hour, config.Retention.BatchSize)
+		if err != nil {
+			stats.error()
+			slog.Error("Error purging old rows", "error", err)
+		}
+	}
+
+	// Outputs that buffer deliver the run's rows now, rather than holding
+	// every run of -watch until exit.
+	if err := c.sink.Flush(); err != nil {
+		stats.error()
+		slog.Error("Error flushing outputs", "error", err)
+	}
+
+	if !dryRun {
+		if err := saveCache(); err != nil {
+			return RunSummary{}, fmt.Errorf("error saving cache %s: %w", cacheFile, err)
+		}
+		if err := incremental.save(); err != nil {
+			return RunSummary{}, fmt.Errorf("error saving incremental state %s: %w", incremental.path, err)
+		}
+	}
+
+	summary := stats.snapshot()
+	summary.IPInfoTokenUsage = ipinfoTokens.Usage()
+	summary.EstimatedLookups = estimate.Uncached
+	summary.LookupCost = float64(summary.Lookups) * config.Lookup.CostPerLookup
+	return summary, nil
+}
+
+// collectAccountURLs collects account's URLs, up to its urlConcurrency at
+// once, until done or ctx ends.
+func collectAccountURLs(ctx context.Context, account Account) {
+	slots := make(chan struct{}, account.urlConcurrency())
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for _, u := range account.streamURLs() {
+		if ctx.Err() != nil {
+			return
+		}
+		if !wantStreamType(u.StreamType) {
+			slog.Debug("Skipping URL of unselected stream type", "account", account.Name, "url", u.URL, "stream_type", u.StreamType)
+			continue
+		}
+		if resume.urlFresh(account.Name, u) {
+			slog.Info("Skipping URL already visited before the last run stopped", "account", account.Name, "url", u.URL, "stream_type", u.StreamType)
+			continue
+		}
+
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		wg.Add(1)
+		go func(u StreamURL) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			collectStreamingURLs(ctx, account, u.URL, u.StreamType)
+			if ctx.Err() != nil {
+				return
+			}
+			if err := resume.urlDone(account.Name, u); err != nil {
+				slog.Warn("Error saving resume state", "path", resume.path, "error", err)
+			}
+		}(u)
+	}
+}
+
+// Close closes the sink, flushing any buffered rows.
+func (c *Collector) Close() error {
+	return c.sink.Close()
+}
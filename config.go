@@ -0,0 +1,607 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configFiles are the names the config is looked for under, in order.
+var configFiles = []string{"config.json", "config.json.gz", "config.yaml", "config.yml"}
+
+// configPath returns the first of configFiles that exists, or config.json
+// so the error names the usual file when none does.
+func configPath() string {
+	for _, name := range configFiles {
+		if _, err := os.Stat(name); err == nil {
+			return name
+		}
+	}
+	return configFiles[0]
+}
+
+// loadConfig reads path, applies defaults and validates the result.
+func loadConfig(path string) (Config, error) {
+	var cfg Config
+
+	configFile, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("error reading config file: %w", err)
+	}
+
+	configFile, err = decompressConfig(path, configFile)
+	if err != nil {
+		return cfg, err
+	}
+
+	if ext := filepath.Ext(strings.TrimSuffix(path, ".gz")); ext == ".yaml" || ext == ".yml" {
+		configFile, err = yamlToJSON(configFile)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	configFile, err = expandEnv(configFile)
+	if err != nil {
+		return cfg, err
+	}
+
+	err = json.Unmarshal(configFile, &cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("error unmarshalling JSON: %w", err)
+	}
+
+	applyDefaults(&cfg)
+	return cfg, validateConfig(cfg)
+}
+
+// decompressConfig gunzips data when path ends in .gz or data starts with
+// the gzip magic bytes, and returns it unchanged otherwise.
+func decompressConfig(path string, data []byte) ([]byte, error) {
+	if !strings.HasSuffix(path, ".gz") && !bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		return data, nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing config file %s: %w", path, err)
+	}
+	defer r.Close()
+	data, err = io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing config file %s: %w", path, err)
+	}
+	return data, nil
+}
+
+// yamlToJSON converts a YAML config to JSON, so it goes through the same
+// environment expansion, field names and validation as a JSON one. Anchors,
+// aliases and merge keys are resolved by the conversion. Mapping keys keep
+// their document order, which the map form of urls depends on.
+func yamlToJSON(data []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("error unmarshalling YAML: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := writeYAMLAsJSON(&buf, &doc); err != nil {
+		return nil, fmt.Errorf("error converting YAML to JSON: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// writeYAMLAsJSON writes n to buf as JSON.
+func writeYAMLAsJSON(buf *bytes.Buffer, n *yaml.Node) error {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) == 0 {
+			buf.WriteString("null")
+			return nil
+		}
+		return writeYAMLAsJSON(buf, n.Content[0])
+	case yaml.AliasNode:
+		return writeYAMLAsJSON(buf, n.Alias)
+	case yaml.SequenceNode:
+		buf.WriteByte('[')
+		for i, item := range n.Content {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeYAMLAsJSON(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		return nil
+	case yaml.MappingNode:
+		buf.WriteByte('{')
+		for i, pair := range yamlMappingPairs(n) {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, err := json.Marshal(pair.key)
+			if err != nil {
+				return err
+			}
+			buf.Write(key)
+			buf.WriteByte(':')
+			if err := writeYAMLAsJSON(buf, pair.value); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+		return nil
+	case yaml.ScalarNode:
+		var v any
+		if err := n.Decode(&v); err != nil {
+			return err
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+		return nil
+	default:
+		return fmt.Errorf("line %d: unsupported YAML node", n.Line)
+	}
+}
+
+type yamlPair struct {
+	key   string
+	value *yaml.Node
+}
+
+// yamlMappingPairs returns n's keys and values in document order. The keys
+// of a merge ("<<: *anchor") take its place, unless the mapping sets them
+// itself or an earlier merge already did.
+func yamlMappingPairs(n *yaml.Node) []yamlPair {
+	explicit := make(map[string]bool)
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if !isYAMLMerge(n.Content[i]) {
+			explicit[n.Content[i].Value] = true
+		}
+	}
+
+	var pairs []yamlPair
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		if !isYAMLMerge(k) {
+			pairs = append(pairs, yamlPair{k.Value, v})
+			continue
+		}
+
+		merged := []*yaml.Node{v}
+		if v = yamlResolve(v); v.Kind == yaml.SequenceNode {
+			merged = v.Content
+		}
+		for _, m := range merged {
+			if m = yamlResolve(m); m.Kind != yaml.MappingNode {
+				continue
+			}
+			for _, p := range yamlMappingPairs(m) {
+				if !explicit[p.key] && !seen[p.key] {
+					seen[p.key] = true
+					pairs = append(pairs, p)
+				}
+			}
+		}
+	}
+	return pairs
+}
+
+func isYAMLMerge(k *yaml.Node) bool {
+	return k.Kind == yaml.ScalarNode && k.ShortTag() == "!!merge"
+}
+
+// yamlResolve follows n if it is an alias.
+func yamlResolve(n *yaml.Node) *yaml.Node {
+	for n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	return n
+}
+
+var (
+	jsonStringPattern = regexp.MustCompile(`"(?:[^"\\]|\\.)*"`)
+	envVarPattern     = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+)
+
+// expandEnv replaces ${VAR} and ${VAR:-default} references inside the JSON
+// string values of data with values from the environment. Referencing an
+// unset variable without a default is an error.
+func expandEnv(data []byte) ([]byte, error) {
+	var missing []string
+
+	data = jsonStringPattern.ReplaceAllFunc(data, func(lit []byte) []byte {
+		if !bytes.Contains(lit, []byte("${")) {
+			return lit
+		}
+
+		var s string
+		if err := json.Unmarshal(lit, &s); err != nil {
+			return lit
+		}
+
+		s = envVarPattern.ReplaceAllStringFunc(s, func(ref string) string {
+			m := envVarPattern.FindStringSubmatch(ref)
+			if v, ok := os.LookupEnv(m[1]); ok && (v != "" || !strings.Contains(ref, ":-")) {
+				return v
+			}
+			if strings.Contains(ref, ":-") {
+				return m[2]
+			}
+			missing = append(missing, m[1])
+			return ""
+		})
+
+		b, _ := json.Marshal(s)
+		return b
+	})
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("config references unset environment variables: %s", strings.Join(missing, ", "))
+	}
+	return data, nil
+}
+
+// applyDefaults fills in settings left empty in the config file.
+func applyDefaults(cfg *Config) {
+	if cfg.URLConcurrency == 0 {
+		cfg.URLConcurrency = 1
+	}
+	if cfg.Timezone == "" {
+		cfg.Timezone = "UTC"
+	}
+	if cfg.Log.Format == "" {
+		cfg.Log.Format = "text"
+	}
+	if cfg.Log.Level == "" {
+		cfg.Log.Level = "info"
+	}
+	if cfg.Cache.NegativeTTLSeconds == 0 {
+		cfg.Cache.NegativeTTLSeconds = 300
+	}
+	if cfg.Cache.Format == "" {
+		cfg.Cache.Format = "gob"
+	}
+	if len(cfg.Lookup.Providers) == 0 {
+		cfg.Lookup.Providers = []string{"ipinfo", "cymru", "whois"}
+	}
+	if cfg.Lookup.DetectionMethod == "" {
+		cfg.Lookup.DetectionMethod = "auto"
+	}
+	if cfg.Lookup.CircuitBreaker.FailureThreshold == 0 {
+		cfg.Lookup.CircuitBreaker.FailureThreshold = 5
+	}
+	if cfg.Lookup.CircuitBreaker.CooldownSeconds == 0 {
+		cfg.Lookup.CircuitBreaker.CooldownSeconds = 60
+	}
+	if cfg.Lookup.WhoisRetry.Attempts == 0 {
+		cfg.Lookup.WhoisRetry.Attempts = 3
+	}
+	if cfg.Lookup.WhoisRetry.BaseDelayMs == 0 {
+		cfg.Lookup.WhoisRetry.BaseDelayMs = 500
+	}
+	if cfg.Lookup.WhoisRetry.MaxDelayMs == 0 {
+		cfg.Lookup.WhoisRetry.MaxDelayMs = 5000
+	}
+	if cfg.Lookup.WhoisTimeoutSeconds == 0 {
+		cfg.Lookup.WhoisTimeoutSeconds = 15
+	}
+	if cfg.Lookup.IPConcurrency == 0 {
+		cfg.Lookup.IPConcurrency = 4
+	}
+	if cfg.Retention.BatchSize == 0 {
+		cfg.Retention.BatchSize = defaultRetentionBatchSize
+	}
+	if cfg.Latency.Method == "" {
+		cfg.Latency.Method = "tcp"
+	}
+	if cfg.Latency.Port == 0 {
+		cfg.Latency.Port = 443
+	}
+	if cfg.Latency.Samples == 0 {
+		cfg.Latency.Samples = 3
+	}
+	if cfg.Latency.TimeoutMs == 0 {
+		cfg.Latency.TimeoutMs = 1000
+	}
+	if cfg.Dedup.Scope == "" {
+		cfg.Dedup.Scope = dedupAccount
+	}
+	if cfg.Incremental.StateFile == "" {
+		cfg.Incremental.StateFile = defaultIncrementalStateFile
+	}
+	if cfg.Database.Partitioning == "" {
+		cfg.Database.Partitioning = "none"
+	}
+	if cfg.Database.TLS.Mode == "" {
+		cfg.Database.TLS.Mode = "disable"
+	}
+	if cfg.Resume.StateFile == "" {
+		cfg.Resume.StateFile = defaultResumeStateFile
+	}
+	if len(cfg.Outputs) == 0 {
+		cfg.Outputs = []OutputConfig{cfg.Output}
+		cfg.Output = OutputConfig{}
+	}
+	for i := range cfg.Outputs {
+		o := &cfg.Outputs[i]
+		if o.Type == "stdout" || (o.Type == "" && isStdout(o.Target)) {
+			o.Type, o.Target = "ndjson", "stdout"
+		}
+		if o.Type == "" {
+			o.Type = "db"
+		}
+	}
+}
+
+var knownOutputTypes = []string{"db", "csv", "ndjson", "elasticsearch", "kafka", "s3"}
+
+// validateConfig reports every problem found in cfg.
+func validateConfig(cfg Config) error {
+	var errs []error
+
+	if _, err := newLogger(os.Stderr, cfg.Log.Format, cfg.Log.Level); err != nil {
+		errs = append(errs, err)
+	}
+
+	if cfg.Cache.Format != "gob" && cfg.Cache.Format != "json" {
+		errs = append(errs, fmt.Errorf("unknown cache format %q", cfg.Cache.Format))
+	}
+	if !cacheNamespacePattern.MatchString(cfg.Cache.Namespace) {
+		errs = append(errs, fmt.Errorf("cache.namespace %q may only contain letters, digits, '-' and '_'", cfg.Cache.Namespace))
+	}
+	if cfg.Cache.FlushIntervalSeconds < 0 || cfg.Cache.MaxAgeDays < 0 {
+		errs = append(errs, fmt.Errorf("cache.flushIntervalSeconds and cache.maxAgeDays must not be negative"))
+	}
+
+	if cfg.JitterPercent < 0 || cfg.JitterPercent > 100 {
+		errs = append(errs, fmt.Errorf("jitterPercent must be between 0 and 100"))
+	}
+
+	for _, p := range cfg.Lookup.Providers {
+		if _, ok := lookupProviders[p]; !ok {
+			errs = append(errs, fmt.Errorf("unknown lookup provider %q", p))
+		}
+	}
+
+	if !validDetectionMethod(cfg.Lookup.DetectionMethod) {
+		errs = append(errs, fmt.Errorf("unknown lookup.detectionMethod %q", cfg.Lookup.DetectionMethod))
+	}
+
+	if _, err := compileFingerprintRules(cfg.Detection.Rules); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := cfg.Database.TLS.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.Database.Partitioning != "none" && cfg.Database.Partitioning != "date" {
+		errs = append(errs, fmt.Errorf("unknown database.partitioning %q, expected none or date", cfg.Database.Partitioning))
+	}
+	if cfg.Database.Socket != "" && (cfg.Database.Host != "" || cfg.Database.Port != "") {
+		errs = append(errs, fmt.Errorf("database.socket and database.host/port are mutually exclusive"))
+	}
+
+	if cfg.Latency.Method != "tcp" && cfg.Latency.Method != "icmp" {
+		errs = append(errs, fmt.Errorf("unknown latency method %q", cfg.Latency.Method))
+	}
+
+	switch cfg.Dedup.Scope {
+	case dedupAccount, dedupGlobal, dedupNone:
+	default:
+		errs = append(errs, fmt.Errorf("unknown dedup scope %q", cfg.Dedup.Scope))
+	}
+
+	if cfg.Retention.MaxAgeDays < 0 || cfg.Retention.BatchSize < 0 {
+		errs = append(errs, fmt.Errorf("retention.maxAgeDays and retention.batchSize must not be negative"))
+	}
+
+	if cfg.Emulation != nil {
+		if _, err := cfg.Emulation.device(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for rir, limit := range cfg.Lookup.WhoisRIRRequestsPerSecond {
+		if _, ok := rirWhoisServers[rir]; !ok && rir != rirDefault {
+			errs = append(errs, fmt.Errorf("unknown registry %q in lookup.whoisRirRequestsPerSecond", rir))
+		} else if limit < 0 {
+			errs = append(errs, fmt.Errorf("lookup.whoisRirRequestsPerSecond[%s] must not be negative", rir))
+		}
+	}
+
+	for i, o := range cfg.Lookup.WhoisServers {
+		if o.Server == "" {
+			errs = append(errs, fmt.Errorf("lookup.whoisServers[%d]: server is required", i))
+		}
+		if o.CIDR == "" && o.HostnameSuffix == "" {
+			errs = append(errs, fmt.Errorf("lookup.whoisServers[%d]: cidr or hostnameSuffix is required", i))
+		}
+		if _, _, err := net.ParseCIDR(o.CIDR); o.CIDR != "" && err != nil {
+			errs = append(errs, fmt.Errorf("lookup.whoisServers[%d]: %w", i, err))
+		}
+	}
+
+	if r := cfg.Lookup.WhoisRetry; r.Attempts < 0 || r.BaseDelayMs < 0 || r.MaxDelayMs < 0 {
+		errs = append(errs, fmt.Errorf("lookup.whoisRetry values must not be negative"))
+	}
+	if cfg.Lookup.IPConcurrency < 0 {
+		errs = append(errs, fmt.Errorf("lookup.ipConcurrency must not be negative"))
+	}
+	if cfg.Lookup.WhoisTimeoutSeconds < 0 {
+		errs = append(errs, fmt.Errorf("lookup.whoisTimeoutSeconds must not be negative"))
+	}
+
+	if cfg.Lookup.MaxLookups < 0 || cfg.Lookup.CostPerLookup < 0 {
+		errs = append(errs, fmt.Errorf("lookup.maxLookups and lookup.costPerLookup must not be negative"))
+	}
+
+	if cfg.RunTimeoutSeconds < 0 {
+		errs = append(errs, fmt.Errorf("runTimeoutSeconds must not be negative"))
+	}
+
+	for i, m := range cfg.OrgNames.Mappings {
+		if err := m.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("orgNames.mappings[%d]: %w", i, err))
+		}
+	}
+
+	if cfg.OrgNames.MaxDistance < 0 {
+		errs = append(errs, fmt.Errorf("orgNames.maxDistance must not be negative"))
+	}
+
+	if cfg.MaxBrowsers < 0 {
+		errs = append(errs, fmt.Errorf("maxBrowsers must not be negative"))
+	}
+
+	if _, err := time.LoadLocation(cfg.Timezone); err != nil {
+		errs = append(errs, fmt.Errorf("invalid timezone %q: %w", cfg.Timezone, err))
+	}
+
+	if cfg.MaxCapturesPerURL < 0 {
+		errs = append(errs, fmt.Errorf("maxCapturesPerURL must not be negative"))
+	}
+
+	if cfg.URLConcurrency < 0 {
+		errs = append(errs, fmt.Errorf("urlConcurrency must not be negative"))
+	}
+
+	usesDB := false
+	for _, o := range cfg.Outputs {
+		switch o.Type {
+		case "db":
+			usesDB = true
+		case "csv", "ndjson":
+			if o.Target == "" {
+				errs = append(errs, fmt.Errorf("%s output requires a target", o.Type))
+			}
+		default:
+			if !slices.Contains(knownOutputTypes, o.Type) {
+				errs = append(errs, fmt.Errorf("unknown output type %q", o.Type))
+			}
+		}
+	}
+
+	for i, a := range cfg.Accounts {
+		if a.Name == "" {
+			errs = append(errs, fmt.Errorf("accounts[%d]: name is required", i))
+		}
+		if len(a.URLs) == 0 && a.URLsFile == "" {
+			errs = append(errs, fmt.Errorf("accounts[%d] (%s): no urls or urlsFile", i, a.Name))
+		}
+		if usesDB && a.DBTableName == "" {
+			errs = append(errs, fmt.Errorf("accounts[%d] (%s): db_table_name is required for the db output", i, a.Name))
+		}
+		if a.DetectionMethod != "" && !validDetectionMethod(a.DetectionMethod) {
+			errs = append(errs, fmt.Errorf("accounts[%d] (%s): unknown detectionMethod %q", i, a.Name, a.DetectionMethod))
+		}
+		for column, source := range a.ExtraColumns {
+			if err := validateExtraColumn(column, source); err != nil {
+				errs = append(errs, fmt.Errorf("accounts[%d] (%s): %w", i, a.Name, err))
+			}
+		}
+		if a.Emulation != nil {
+			if _, err := a.Emulation.device(); err != nil {
+				errs = append(errs, fmt.Errorf("accounts[%d] (%s): %w", i, a.Name, err))
+			}
+		}
+		for j, c := range a.Cookies {
+			if c.Name == "" {
+				errs = append(errs, fmt.Errorf("accounts[%d] (%s): cookies[%d]: name is required", i, a.Name, j))
+			}
+		}
+		if a.SleepDuration < 0 {
+			errs = append(errs, fmt.Errorf("accounts[%d] (%s): sleepDuration must not be negative", i, a.Name))
+		}
+		if a.CaptureTimeoutSeconds > 0 && a.CaptureTimeoutSeconds < a.SleepDuration {
+			errs = append(errs, fmt.Errorf("accounts[%d] (%s): captureTimeoutSeconds must be at least sleepDuration", i, a.Name))
+		}
+		if a.MaxCapturesPerURL < 0 {
+			errs = append(errs, fmt.Errorf("accounts[%d] (%s): maxCapturesPerURL must not be negative", i, a.Name))
+		}
+		if a.URLConcurrency < 0 {
+			errs = append(errs, fmt.Errorf("accounts[%d] (%s): urlConcurrency must not be negative", i, a.Name))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validDetectionMethod reports whether m is "auto", "headers" or a lookup
+// provider.
+func validDetectionMethod(m string) bool {
+	_, ok := lookupProviders[m]
+	return ok || m == "auto" || m == "headers"
+}
+
+// sensitiveKeys are matched against JSON keys whose values must never be
+// printed, ignoring case, dashes and underscores, so "api_key" and
+// "X-Api-Key" match "apikey". Every value under an account's headers and
+// cookies is covered, since either may carry credentials.
+var sensitiveKeys = []string{"password", "token", "secret", "apikey", "encryptionkey", "authheader", "webhookurl", "authorization", "cookie", "headers"}
+
+// keySeparators are dropped from keys before matching sensitiveKeys.
+var keySeparators = strings.NewReplacer("-", "", "_", "")
+
+// redactedConfigJSON renders cfg as indented JSON with every secret value
+// replaced, so the output is safe to paste into an issue.
+func redactedConfigJSON(cfg Config) ([]byte, error) {
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(redact(v, false), "", "  ")
+}
+
+func redact(v any, sensitive bool) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			v[k] = redact(child, sensitive || isSensitiveKey(k))
+		}
+		return v
+	case []any:
+		for i, child := range v {
+			v[i] = redact(child, sensitive)
+		}
+		return v
+	case string:
+		if sensitive && v != "" {
+			return "REDACTED"
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func isSensitiveKey(k string) bool {
+	k = keySeparators.Replace(strings.ToLower(k))
+	for _, s := range sensitiveKeys {
+		if strings.Contains(k, s) {
+			return true
+		}
+	}
+	return false
+}
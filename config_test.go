@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRedactIgnoresKeySeparators(t *testing.T) {
+	var v any
+	if err := json.Unmarshal([]byte(`{"api_key": "k1", "X-Api-Key": "k2", "webhook_url": "u", "name": "example"}`), &v); err != nil {
+		t.Fatal(err)
+	}
+	got := redact(v, false).(map[string]any)
+
+	for _, k := range []string{"api_key", "X-Api-Key", "webhook_url"} {
+		if got[k] != "REDACTED" {
+			t.Errorf("%s = %q, want REDACTED", k, got[k])
+		}
+	}
+	if got["name"] != "example" {
+		t.Errorf("name = %q, want it kept", got["name"])
+	}
+}
+
+func TestRedactedConfigJSONHidesHeadersAndCookies(t *testing.T) {
+	var cfg Config
+	cfg.Accounts = []Account{{
+		Name:    "example",
+		Headers: map[string]string{"X-Session": "s3cret"},
+		Cookies: []Cookie{{Name: "sid", Value: "s3cret"}},
+	}}
+
+	b, err := redactedConfigJSON(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Accounts []struct {
+			Headers map[string]string `json:"headers"`
+			Cookies []Cookie          `json:"cookies"`
+		} `json:"accounts"`
+	}
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	a := out.Accounts[0]
+	if a.Headers["X-Session"] != "REDACTED" || a.Cookies[0].Value != "REDACTED" {
+		t.Errorf("headers %v and cookies %v, want every value redacted", a.Headers, a.Cookies)
+	}
+}
+
+func TestYAMLToJSONKeepsKeyOrder(t *testing.T) {
+	in := `
+defaults: &defaults
+  sleepDuration: 30
+  unit: video
+accounts:
+  - name: example
+    <<: *defaults
+    unit: audio
+    urls:
+      ondemand: https://example.com/vod
+      live: https://example.com/live
+      events: ~
+`
+	got, err := yamlToJSON([]byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"defaults":{"sleepDuration":30,"unit":"video"},"accounts":[{"name":"example","sleepDuration":30,"unit":"audio","urls":{"ondemand":"https://example.com/vod","live":"https://example.com/live","events":null}}]}`
+	if string(got) != want {
+		t.Errorf("yamlToJSON() =\n%s\nwant\n%s", got, want)
+	}
+}
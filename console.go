@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/chromedp/cdproto/runtime"
+)
+
+// maxConsoleLines caps the console output kept per page.
+const maxConsoleLines = 100
+
+// recordConsole logs a console call or uncaught exception from the page and
+// keeps it, so it can be reported if the page produces no media.
+func (c *capture) recordConsole(ev any) {
+	var line string
+	switch ev := ev.(type) {
+	case *runtime.EventConsoleAPICalled:
+		args := make([]string, 0, len(ev.Args))
+		for _, a := range ev.Args {
+			args = append(args, remoteObjectString(a))
+		}
+		line = fmt.Sprintf("console.%s: %s", ev.Type, strings.Join(args, " "))
+	case *runtime.EventExceptionThrown:
+		d := ev.ExceptionDetails
+		text := d.Text
+		if d.Exception != nil && d.Exception.Description != "" {
+			text = d.Exception.Description
+		}
+		line = fmt.Sprintf("exception: %s (%s:%d)", text, d.URL, d.LineNumber+1)
+	default:
+		return
+	}
+
+	slog.Debug("Console", "account", c.account.Name, "url", c.url, "message", line)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.console) < maxConsoleLines {
+		c.console = append(c.console, line)
+	}
+}
+
+func (c *capture) consoleLines() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.console
+}
+
+// remoteObjectString renders a console argument roughly as devtools does.
+func remoteObjectString(o *runtime.RemoteObject) string {
+	if len(o.Value) > 0 {
+		var s string
+		if json.Unmarshal([]byte(o.Value), &s) == nil {
+			return s
+		}
+		return string(o.Value)
+	}
+	if o.UnserializableValue != "" {
+		return string(o.UnserializableValue)
+	}
+	return o.Description
+}
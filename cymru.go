@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+// Team Cymru's DNS-based IP to ASN service needs no API key. See
+// https://www.team-cymru.com/ip-asn-mapping.
+const (
+	cymruOriginZone  = "origin.asn.cymru.com"
+	cymruOrigin6Zone = "origin6.asn.cymru.com"
+	cymruASNZone     = "asn.cymru.com"
+)
+
+var errNoAnnouncement = errors.New("no BGP announcement")
+
+// cymruOrigin is the origin AS and BGP prefix announcing an IP, and the
+// registry ("arin", "ripencc", ...) the IP was allocated by.
+type cymruOrigin struct {
+	ASN      string
+	Prefix   string
+	Registry string
+}
+
+// lookupCymru looks up the CDN org for ip from the AS that announces it.
+func lookupCymru(ctx context.Context, hostname string, ip net.IP) (CdnShareData, error) {
+	if err := lookupLimiter.Wait(ctx); err != nil {
+		return CdnShareData{}, err
+	}
+
+	lookupsTotal.WithLabelValues("cymru").Inc()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	origin, err := cymruLookupOrigin(ctx, ip)
+	if err != nil {
+		return CdnShareData{}, err
+	}
+	asName, err := cymruLookupASName(ctx, origin.ASN)
+	if err != nil {
+		return CdnShareData{}, err
+	}
+
+	// Keep the "ASnnn" form so ASN-based detection works as with ipinfo.
+	parsed := fmt.Sprintf("AS%s %s | %s", origin.ASN, asName, origin.Prefix)
+	prettyName := prettyCdnOrgName(asName)
+
+	cachePut(ip, WhoisCacheData{
+		Timestamp:   time.Now(),
+		CdnOrgName:  prettyName,
+		ParsedWhois: parsed,
+		Prefix:      origin.Prefix,
+		Provider:    "cymru",
+	})
+	slog.Debug("Looked up CDN org", "provider", "cymru", "hostname", hostname, "ip", ip.String(), "cdn_org", prettyName)
+	return CdnShareData{
+		Timestamp:        observationTime(),
+		CdnIp:            ip.String(),
+		CustomerHostname: hostname,
+		CdnOrgName:       prettyName,
+		ParsedWhois:      parsed,
+		Prefix:           origin.Prefix,
+	}, nil
+}
+
+// cymruOriginName returns the origin query name for ip: reversed octets for
+// IPv4, reversed nibbles for IPv6.
+func cymruOriginName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.%s", ip4[3], ip4[2], ip4[1], ip4[0], cymruOriginZone)
+	}
+
+	ip16 := ip.To16()
+	var b strings.Builder
+	for i := len(ip16) - 1; i >= 0; i-- {
+		fmt.Fprintf(&b, "%x.%x.", ip16[i]&0xf, ip16[i]>>4)
+	}
+	return b.String() + cymruOrigin6Zone
+}
+
+// cymruLookupOrigin returns the origin AS announcing ip. An IP covered by
+// several announcements resolves to the most specific prefix.
+func cymruLookupOrigin(ctx context.Context, ip net.IP) (cymruOrigin, error) {
+	records, err := net.DefaultResolver.LookupTXT(ctx, cymruOriginName(ip))
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return cymruOrigin{}, errNoAnnouncement
+	} else if err != nil {
+		return cymruOrigin{}, err
+	}
+
+	var best cymruOrigin
+	bestBits := -1
+	for _, r := range records {
+		// "13335 | 104.16.0.0/13 | US | arin | 2014-03-28"
+		fields := cymruFields(r)
+		if len(fields) < 2 || fields[0] == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(fields[1])
+		if err != nil {
+			continue
+		}
+		if bits, _ := network.Mask.Size(); bits > bestBits {
+			// The origin may be an AS set ("13335 209242"); take the first.
+			best = cymruOrigin{ASN: strings.Fields(fields[0])[0], Prefix: network.String()}
+			if len(fields) >= 4 {
+				best.Registry = fields[3]
+			}
+			bestBits = bits
+		}
+	}
+
+	if bestBits < 0 {
+		return cymruOrigin{}, errNoAnnouncement
+	}
+	return best, nil
+}
+
+// cymruLookupASName returns the registered name of asn.
+func cymruLookupASName(ctx context.Context, asn string) (string, error) {
+	records, err := net.DefaultResolver.LookupTXT(ctx, "AS"+asn+"."+cymruASNZone)
+	if err != nil {
+		return "", fmt.Errorf("error looking up AS%s: %w", asn, err)
+	}
+
+	for _, r := range records {
+		// "13335 | US | arin | 2010-07-14 | CLOUDFLARENET - Cloudflare, Inc., US"
+		fields := cymruFields(r)
+		if len(fields) >= 5 && fields[4] != "" {
+			return fields[4], nil
+		}
+	}
+	return "", fmt.Errorf("no name for AS%s", asn)
+}
+
+func cymruFields(record string) []string {
+	fields := strings.Split(record, "|")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	return fields
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// dbTLSConfigName is the name the database TLS config is registered under
+// with the mysql driver.
+const dbTLSConfigName = "cdnshare"
+
+var dbTLSModes = []string{"disable", "require", "verify-ca", "verify-full"}
+
+// DatabaseTLS configures TLS for the database connection. Mode is
+// "disable" (default), "require" (encrypt without verifying the server),
+// "verify-ca" (verify the server's certificate chain) or "verify-full"
+// (also verify that the certificate matches Host). CA verifies the server
+// against a PEM file instead of the system roots, and Cert and Key present
+// a client certificate.
+type DatabaseTLS struct {
+	Mode string `json:"mode"`
+	CA   string `json:"ca"`
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+func (t DatabaseTLS) validate() error {
+	var errs []error
+	if !slices.Contains(dbTLSModes, t.Mode) {
+		errs = append(errs, fmt.Errorf("unknown database.tls.mode %q, expected one of %v", t.Mode, dbTLSModes))
+	}
+	if (t.Cert == "") != (t.Key == "") {
+		errs = append(errs, errors.New("database.tls.cert and database.tls.key must be set together"))
+	}
+	if t.Mode == "disable" && (t.CA != "" || t.Cert != "") {
+		errs = append(errs, errors.New("database.tls files are set but database.tls.mode is disable"))
+	}
+	return errors.Join(errs...)
+}
+
+// registerDBTLS registers the TLS config for t with the mysql driver and
+// returns the DSN's tls parameter, or "" when TLS is disabled.
+func registerDBTLS(t DatabaseTLS, host string) (string, error) {
+	if t.Mode == "" || t.Mode == "disable" {
+		return "", nil
+	}
+
+	cfg := &tls.Config{ServerName: host}
+
+	var roots *x509.CertPool
+	if t.CA != "" {
+		pem, err := os.ReadFile(t.CA)
+		if err != nil {
+			return "", fmt.Errorf("error reading database CA: %w", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return "", fmt.Errorf("no certificates found in database CA %s", t.CA)
+		}
+		cfg.RootCAs = roots
+	}
+
+	if t.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return "", fmt.Errorf("error loading database client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	switch t.Mode {
+	case "require":
+		cfg.InsecureSkipVerify = true
+	case "verify-ca":
+		// Verify the chain ourselves, without the hostname check that
+		// crypto/tls would add.
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyCertChain(rawCerts, roots)
+		}
+	}
+
+	if err := mysql.RegisterTLSConfig(dbTLSConfigName, cfg); err != nil {
+		return "", err
+	}
+	return dbTLSConfigName, nil
+}
+
+// verifyCertChain verifies the server's certificate chain against roots,
+// or the system roots when nil, ignoring the hostname.
+func verifyCertChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return errors.New("server sent no certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+	return err
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDatabaseDSN(t *testing.T) {
+	prevConfig, prevLoc := config, timestampLocation
+	t.Cleanup(func() { config, timestampLocation = prevConfig, prevLoc })
+
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	tests := []struct {
+		name   string
+		socket string
+		tls    string
+		loc    *time.Location
+		want   string
+	}{
+		{
+			name: "tcp",
+			want: "u:p@tcp(db.example.com:3306)/cdn?parseTime=true",
+		},
+		{
+			name:   "socket",
+			socket: "/run/mysqld/mysqld.sock",
+			want:   "u:p@unix(/run/mysqld/mysqld.sock)/cdn?parseTime=true",
+		},
+		{
+			name: "tls",
+			tls:  "require",
+			want: "u:p@tcp(db.example.com:3306)/cdn?parseTime=true&tls=" + dbTLSConfigName,
+		},
+		{
+			name: "tls disabled",
+			tls:  "disable",
+			want: "u:p@tcp(db.example.com:3306)/cdn?parseTime=true",
+		},
+		{
+			name: "loc",
+			loc:  newYork,
+			want: "u:p@tcp(db.example.com:3306)/cdn?parseTime=true&loc=America%2FNew_York",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Database.Host, config.Database.Port = "db.example.com", "3306"
+			config.Database.User, config.Database.Password, config.Database.Database = "u", "p", "cdn"
+			if tt.socket != "" {
+				// validateConfig rejects a socket alongside a host and port.
+				config.Database.Host, config.Database.Port = "", ""
+			}
+			config.Database.Socket = tt.socket
+			config.Database.TLS = DatabaseTLS{Mode: tt.tls}
+			timestampLocation = time.UTC
+			if tt.loc != nil {
+				timestampLocation = tt.loc
+			}
+
+			got, err := databaseDSN()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("databaseDSN() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// debugRequests and debugDir are set by the -debug and -debug-dir flags.
+var (
+	debugRequests bool
+	debugDir      string
+)
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// openRequestDump creates the -debug-dir file that every request made while
+// capturing c is written to, one "matched<TAB>url" line each.
+func openRequestDump(c *capture) (*os.File, error) {
+	if err := os.MkdirAll(debugDir, 0777); err != nil {
+		return nil, err
+	}
+	return os.Create(filepath.Join(debugDir, captureFileName(c, time.Now(), ".tsv")))
+}
+
+// captureFileName returns a file name for output about capture c started at
+// t, built from the account name and URL.
+func captureFileName(c *capture, t time.Time, ext string) string {
+	name := unsafeFileChars.ReplaceAllString(c.account.Name+"_"+c.url, "_")
+	if len(name) > 150 {
+		name = name[:150]
+	}
+	return name + "_" + t.UTC().Format("20060102T150405Z") + ext
+}
+
+// debugRequest logs a request seen while capturing c and whether it matched
+// the media filters.
+func debugRequest(c *capture, requestURL string, matched bool) {
+	slog.Debug("Request", "account", c.account.Name, "url", c.url, "request_url", requestURL, "matched", matched)
+
+	if c.requestDump != nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		fmt.Fprintf(c.requestDump, "%t\t%s\n", matched, requestURL)
+	}
+}
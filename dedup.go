@@ -0,0 +1,59 @@
+package main
+
+import "sync"
+
+const (
+	dedupAccount = "account"
+	dedupGlobal  = "global"
+	dedupNone    = "none"
+)
+
+// observed holds the observations already recorded in this run. It is
+// created fresh for every run, so nothing carries over between runs.
+var observed *dedupSet
+
+// dedupSet remembers (hostname, ip, stream type) tuples so each one is
+// looked up and written once per run, however many segment requests hit it.
+type dedupSet struct {
+	scope string
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+func newDedupSet(scope string) *dedupSet {
+	return &dedupSet{scope: scope, seen: make(map[string]struct{})}
+}
+
+// key builds the dedup key for an observation. The account is only part of
+// the key in account scope.
+func (d *dedupSet) key(account, hostname, ip, streamType string) string {
+	if d.scope != dedupAccount {
+		account = ""
+	}
+	return account + "\x00" + hostname + "\x00" + ip + "\x00" + streamType
+}
+
+// add records key and reports whether it was new. In "none" scope every key
+// is new.
+func (d *dedupSet) add(key string) bool {
+	if d.scope == dedupNone {
+		return true
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.seen[key]; ok {
+		return false
+	}
+	d.seen[key] = struct{}{}
+	return true
+}
+
+// remove forgets key, so an observation that failed to be recorded is
+// retried on the next matching request.
+func (d *dedupSet) remove(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.seen, key)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/chromedp/cdproto/network"
+)
+
+// Signal is one piece of evidence about which CDN serves a request.
+type Signal struct {
+	Source string `json:"source"`
+	Value  string `json:"value"`
+	CDN    string `json:"cdn"`
+}
+
+// Candidate is a CDN and the share of signals that pointed at it.
+type Candidate struct {
+	CDN   string  `json:"cdn"`
+	Score float64 `json:"score"`
+}
+
+// candidatesJSON encodes candidates as a JSON array for the alternatives
+// column, or "" if there are none.
+func candidatesJSON(candidates []Candidate) string {
+	if len(candidates) == 0 {
+		return ""
+	}
+	b, err := json.Marshal(candidates)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// DetectionResult is the fused outcome of all available signals.
+type DetectionResult struct {
+	CDN          string
+	Confidence   float64
+	Alternatives []Candidate
+	Signals      []Signal
+	// TLSIssuer is the edge certificate's issuer CN, when TLS detection ran.
+	TLSIssuer string
+}
+
+type suffixMapping struct {
+	Suffix string
+	CDN    string
+}
+
+type headerMapping struct {
+	Header string
+	// Contains, when set, must appear in the header value.
+	Contains string
+	CDN      string
+}
+
+var asnCDNs = map[string]string{
+	"16509": "Amazon, Inc.",
+	"14618": "Amazon, Inc.",
+	"54113": "Fastly, Inc.",
+	"20940": "Akamai, Inc.",
+	"16625": "Akamai, Inc.",
+	"13335": "Cloudflare, Inc.",
+	"15133": "Edgecast Inc.",
+	"22822": "Limelight Networks, Inc.",
+	"33438": "StackPath LLC.",
+	"12989": "StackPath LLC.",
+	"15169": "Google LLC",
+}
+
+var ptrSuffixCDNs = []suffixMapping{
+	{Suffix: ".akamaitechnologies.com", CDN: "Akamai, Inc."},
+	{Suffix: ".cloudfront.net", CDN: "Amazon, Inc."},
+	{Suffix: ".llnw.net", CDN: "Limelight Networks, Inc."},
+	{Suffix: ".edgecastcdn.net", CDN: "Edgecast Inc."},
+	{Suffix: ".1e100.net", CDN: "Google LLC"},
+}
+
+var cnameSuffixCDNs = []suffixMapping{
+	{Suffix: ".akamaiedge.net", CDN: "Akamai, Inc."},
+	{Suffix: ".akamaized.net", CDN: "Akamai, Inc."},
+	{Suffix: ".edgekey.net", CDN: "Akamai, Inc."},
+	{Suffix: ".edgesuite.net", CDN: "Akamai, Inc."},
+	{Suffix: ".cloudfront.net", CDN: "Amazon, Inc."},
+	{Suffix: ".fastly.net", CDN: "Fastly, Inc."},
+	{Suffix: ".fastlylb.net", CDN: "Fastly, Inc."},
+	{Suffix: ".cdn.cloudflare.net", CDN: "Cloudflare, Inc."},
+	{Suffix: ".llnwd.net", CDN: "Limelight Networks, Inc."},
+	{Suffix: ".edgecastcdn.net", CDN: "Edgecast Inc."},
+	{Suffix: ".hwcdn.net", CDN: "StackPath LLC."},
+}
+
+var headerCDNs = []headerMapping{
+	{Header: "x-amz-cf-id", CDN: "Amazon, Inc."},
+	{Header: "x-amz-cf-pop", CDN: "Amazon, Inc."},
+	{Header: "x-fastly-request-id", CDN: "Fastly, Inc."},
+	{Header: "x-served-by", Contains: "cache-", CDN: "Fastly, Inc."},
+	{Header: "akamai-grn", CDN: "Akamai, Inc."},
+	{Header: "x-akamai-transformed", CDN: "Akamai, Inc."},
+	{Header: "cf-ray", CDN: "Cloudflare, Inc."},
+	{Header: "server", Contains: "cloudflare", CDN: "Cloudflare, Inc."},
+	{Header: "server", Contains: "ecacc", CDN: "Edgecast Inc."},
+	{Header: "x-hw", CDN: "StackPath LLC."},
+	{Header: "x-llid", CDN: "Limelight Networks, Inc."},
+}
+
+var asnPattern = regexp.MustCompile(`\bAS(\d+)\b`)
+
+// ptrCache and cnameCache memoize reverse and CNAME lookups for the process.
+var ptrCache, cnameCache sync.Map
+
+// detectCDN fuses the org, ASN, PTR, CNAME, response header and (optionally)
+// TLS certificate signals for data and picks the CDN most of them agree on.
+func detectCDN(c *capture, data CdnShareData) DetectionResult {
+	var signals []Signal
+
+	if data.CdnOrgName != "" {
+		signals = append(signals, Signal{Source: "org", Value: data.CdnOrgName, CDN: data.CdnOrgName})
+	}
+
+	facts := fingerprintFacts{org: data.CdnOrgName}
+
+	if m := asnPattern.FindStringSubmatch(data.ParsedWhois); m != nil {
+		facts.asn = m[1]
+		if cdn, ok := asnCDNs[m[1]]; ok {
+			signals = append(signals, Signal{Source: "asn", Value: m[0], CDN: cdn})
+		}
+	}
+
+	facts.ptrs = lookupPTR(data.CdnIp)
+	for _, ptr := range facts.ptrs {
+		if cdn := matchSuffix(ptr, ptrSuffixCDNs); cdn != "" {
+			signals = append(signals, Signal{Source: "ptr", Value: ptr, CDN: cdn})
+			break
+		}
+	}
+
+	if facts.cname = lookupCNAME(data.CustomerHostname); facts.cname != "" {
+		if cdn := matchSuffix(facts.cname, cnameSuffixCDNs); cdn != "" {
+			signals = append(signals, Signal{Source: "cname", Value: facts.cname, CDN: cdn})
+		}
+	}
+
+	if c != nil {
+		facts.headers = c.headersFor(data.CustomerHostname)
+		signals = append(signals, headerSignals(facts.headers)...)
+	}
+
+	var issuer string
+	if config.Detection.TLS {
+		if cert, ok := fetchTLSCert(data.CdnIp, data.CustomerHostname); ok {
+			issuer = cert.Issuer
+			signals = append(signals, tlsSignals(cert)...)
+		}
+	}
+
+	result := fuseSignals(signals)
+	result.TLSIssuer = issuer
+
+	// A matching fingerprint rule combines several signals, so it decides
+	// the CDN outright and the voted CDNs become alternatives.
+	if rule, ok := matchFingerprint(fingerprintRules(), facts); ok {
+		var candidates []Candidate
+		if result.CDN != "" {
+			candidates = append([]Candidate{{CDN: result.CDN, Score: result.Confidence}}, result.Alternatives...)
+		}
+		result.Alternatives = slices.DeleteFunc(candidates, func(a Candidate) bool { return a.CDN == rule.CDN })
+		result.CDN, result.Confidence = rule.CDN, 1
+		result.Signals = append(result.Signals, Signal{Source: "rule", Value: rule.Name, CDN: rule.CDN})
+	}
+	return result
+}
+
+// fuseSignals scores each CDN by the share of signals naming it. Every
+// signal's CDN goes through the pretty-name mappings first, so the built-in
+// tables and the org lookup vote under the same names. A tie goes to the CDN
+// the org signal names, then alphabetically.
+func fuseSignals(signals []Signal) DetectionResult {
+	result := DetectionResult{Signals: signals}
+	if len(signals) == 0 {
+		return result
+	}
+
+	votes := make(map[string]int)
+	var orgCDN string
+	for i := range signals {
+		signals[i].CDN = prettyCdnOrgName(signals[i].CDN)
+		votes[signals[i].CDN]++
+		if signals[i].Source == "org" {
+			orgCDN = signals[i].CDN
+		}
+	}
+
+	for cdn, n := range votes {
+		result.Alternatives = append(result.Alternatives, Candidate{CDN: cdn, Score: float64(n) / float64(len(signals))})
+	}
+	slices.SortFunc(result.Alternatives, func(a, b Candidate) int {
+		if a.Score != b.Score {
+			if a.Score > b.Score {
+				return -1
+			}
+			return 1
+		}
+		if (a.CDN == orgCDN) != (b.CDN == orgCDN) {
+			if a.CDN == orgCDN {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.CDN, b.CDN)
+	})
+
+	best := result.Alternatives[0]
+	result.CDN, result.Confidence = best.CDN, best.Score
+	result.Alternatives = result.Alternatives[1:]
+	return result
+}
+
+func headerSignals(headers map[string]string) []Signal {
+	var signals []Signal
+	seen := make(map[string]bool)
+	for _, m := range headerCDNs {
+		v, ok := headers[m.Header]
+		if !ok || seen[m.CDN] || !strings.Contains(strings.ToLower(v), m.Contains) {
+			continue
+		}
+		seen[m.CDN] = true
+		signals = append(signals, Signal{Source: "header", Value: m.Header, CDN: m.CDN})
+	}
+	return signals
+}
+
+func matchSuffix(name string, mappings []suffixMapping) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, m := range mappings {
+		if strings.HasSuffix(name, m.Suffix) {
+			return m.CDN
+		}
+	}
+	return ""
+}
+
+func lookupPTR(ip string) []string {
+	if v, ok := ptrCache.Load(ip); ok {
+		return v.([]string)
+	}
+	names, _ := net.LookupAddr(ip)
+	ptrCache.Store(ip, names)
+	return names
+}
+
+func lookupCNAME(hostname string) string {
+	if v, ok := cnameCache.Load(hostname); ok {
+		return v.(string)
+	}
+	cname, _ := net.LookupCNAME(hostname)
+	if strings.TrimSuffix(cname, ".") == hostname {
+		cname = ""
+	}
+	cnameCache.Store(hostname, cname)
+	return cname
+}
+
+// recordHeaders keeps the latest response headers seen for each host, for
+// use as a detection signal.
+func (c *capture) recordHeaders(ev *network.EventResponseReceived) {
+	host := hostOf(ev.Response.URL)
+	if host == "" {
+		return
+	}
+
+	headers := make(map[string]string, len(ev.Response.Headers))
+	for k, v := range ev.Response.Headers {
+		if s, ok := v.(string); ok {
+			headers[strings.ToLower(k)] = s
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.headers == nil {
+		c.headers = make(map[string]map[string]string)
+	}
+	c.headers[host] = headers
+}
+
+func (c *capture) headersFor(host string) map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.headers[host]
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestFuseSignalsVotesUnderPrettyNames(t *testing.T) {
+	t.Cleanup(func() { orgNames.Store(nil) })
+	orgNames.Store(&OrgNamesConfig{Mappings: []PrettyNameMapping{{Pattern: "FASTLY", PrettyName: "Fastly, Inc."}}})
+
+	result := fuseSignals([]Signal{
+		{Source: "org", Value: "FASTLY", CDN: "FASTLY"},
+		{Source: "cname", Value: "example.global.fastly.net", CDN: "Fastly, Inc."},
+		{Source: "header", Value: "cf-ray", CDN: "Cloudflare, Inc."},
+	})
+	if result.CDN != "Fastly, Inc." || result.Confidence != 2.0/3 {
+		t.Errorf("fuseSignals() = %q at %v, want Fastly, Inc. at 2/3", result.CDN, result.Confidence)
+	}
+}
+
+func TestFuseSignalsTiePrefersOrg(t *testing.T) {
+	t.Cleanup(func() { orgNames.Store(nil) })
+	orgNames.Store(&OrgNamesConfig{})
+
+	result := fuseSignals([]Signal{
+		{Source: "header", Value: "akamai-grn", CDN: "Akamai, Inc."},
+		{Source: "org", Value: "Zeta Edge", CDN: "Zeta Edge"},
+	})
+	if result.CDN != "Zeta Edge" {
+		t.Errorf("fuseSignals() = %q, want the org signal's Zeta Edge", result.CDN)
+	}
+}
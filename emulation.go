@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/chromedp/cdproto/emulation"
+	"github.com/chromedp/chromedp"
+	"github.com/chromedp/chromedp/device"
+)
+
+// Emulation describes the device the browser pretends to be. Device names a
+// preset such as "iPhone 14" or "Pixel 5"; the other fields set the viewport
+// explicitly, or override the preset's values when Device is also set.
+type Emulation struct {
+	Device string `json:"device"`
+	// Name is stored with each observation as emulation_profile. It
+	// defaults to Device, or "custom" without one.
+	Name              string  `json:"name"`
+	Width             int64   `json:"width"`
+	Height            int64   `json:"height"`
+	DeviceScaleFactor float64 `json:"deviceScaleFactor"`
+	Mobile            bool    `json:"mobile"`
+	Touch             bool    `json:"touch"`
+	Landscape         bool    `json:"landscape"`
+}
+
+// devicePresets maps lower-cased chromedp device names to their settings.
+var devicePresets = func() map[string]device.Info {
+	presets := make(map[string]device.Info)
+	for d := device.Reset + 1; d <= device.MotoG4landscape; d++ {
+		presets[strings.ToLower(d.String())] = d.Device()
+	}
+	return presets
+}()
+
+// emulation returns the account's emulation settings, falling back to the
+// global default. Nil means the browser's own desktop viewport.
+func (a Account) emulation() *Emulation {
+	if a.Emulation != nil {
+		return a.Emulation
+	}
+	return config.Emulation
+}
+
+// profileName is the name stored with observations made under e.
+func (e *Emulation) profileName() string {
+	if e == nil {
+		return ""
+	}
+	if e.Name != "" {
+		return e.Name
+	}
+	if e.Device != "" {
+		return e.Device
+	}
+	return "custom"
+}
+
+// device resolves e to the settings passed to chromedp.Emulate.
+func (e *Emulation) device() (device.Info, error) {
+	var info device.Info
+	if e.Device != "" {
+		preset, ok := devicePresets[strings.ToLower(e.Device)]
+		if !ok {
+			return info, fmt.Errorf("unknown emulation device %q", e.Device)
+		}
+		info = preset
+	}
+
+	info.Name = e.profileName()
+	if e.Width > 0 {
+		info.Width = e.Width
+	}
+	if e.Height > 0 {
+		info.Height = e.Height
+	}
+	if e.DeviceScaleFactor > 0 {
+		info.Scale = e.DeviceScaleFactor
+	}
+	info.Mobile = info.Mobile || e.Mobile
+	info.Touch = info.Touch || e.Touch
+	info.Landscape = info.Landscape || e.Landscape
+
+	if info.Width <= 0 || info.Height <= 0 {
+		return info, fmt.Errorf("emulation %q needs a device or a width and height", info.Name)
+	}
+	if info.Scale == 0 {
+		info.Scale = 1
+	}
+	return info, nil
+}
+
+// emulateAction returns the action applying the account's emulation, or nil
+// if it has none. The config has been validated, so the device resolves.
+func (a Account) emulateAction() chromedp.Action {
+	e := a.emulation()
+	if e == nil {
+		return nil
+	}
+	info, _ := e.device()
+	if info.UserAgent != "" {
+		return chromedp.Emulate(info)
+	}
+
+	// A custom viewport keeps Chrome's User-Agent, which Emulate would
+	// otherwise clear.
+	orientation := &emulation.ScreenOrientation{Type: emulation.OrientationTypePortraitPrimary}
+	if info.Landscape {
+		orientation = &emulation.ScreenOrientation{Type: emulation.OrientationTypeLandscapePrimary, Angle: 90}
+	}
+	return chromedp.Tasks{
+		emulation.SetDeviceMetricsOverride(info.Width, info.Height, info.Scale, info.Mobile).WithScreenOrientation(orientation),
+		emulation.SetTouchEmulationEnabled(info.Touch),
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// lookupEstimate is the pre-run guess at how many provider calls a run
+// will make.
+type lookupEstimate struct {
+	Hostnames int
+	Uncached  int
+}
+
+// estimateTimeout bounds the DNS lookups of estimateLookups, and
+// estimateConcurrency how many run at once, so an unreachable resolver
+// can't hold up the run.
+const (
+	estimateTimeout     = 10 * time.Second
+	estimateConcurrency = 16
+)
+
+// estimateLookups resolves the distinct hostnames of the accounts' URLs
+// and counts those whose IP is not in the cache. Media is usually served
+// from other hosts than the page, so this is a lower bound, but it shows
+// how much the cache will save. Accounts using header detection make no
+// lookups and are left out, as are hostnames that don't resolve within
+// estimateTimeout or before ctx ends.
+func estimateLookups(ctx context.Context, accounts []Account) lookupEstimate {
+	var hostnames []string
+	seen := make(map[string]bool)
+	for _, a := range accounts {
+		if a.detectionMethod() == "headers" {
+			continue
+		}
+		for _, u := range a.streamURLs() {
+			if !wantStreamType(u.StreamType) {
+				continue
+			}
+			parsedURL, err := url.Parse(u.URL)
+			if err != nil || seen[parsedURL.Hostname()] {
+				continue
+			}
+			seen[parsedURL.Hostname()] = true
+			hostnames = append(hostnames, parsedURL.Hostname())
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, estimateTimeout)
+	defer cancel()
+
+	var e lookupEstimate
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, estimateConcurrency)
+	for _, hostname := range hostnames {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return e
+		}
+		wg.Add(1)
+		go func(hostname string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			ips, err := net.DefaultResolver.LookupIP(ctx, "ip", hostname)
+			if err != nil {
+				return
+			}
+			_, cached := cacheGet(ips[0])
+
+			mu.Lock()
+			defer mu.Unlock()
+			e.Hostnames++
+			if !cached {
+				e.Uncached++
+			}
+		}(hostname)
+	}
+	wg.Wait()
+	return e
+}
+
+func printLookupEstimate(w io.Writer, e lookupEstimate) {
+	fmt.Fprintf(w, "Lookup estimate: %d hostnames, %d not cached, ~%d fresh lookups", e.Hostnames, e.Uncached, e.Uncached)
+	if price := config.Lookup.CostPerLookup; price > 0 {
+		fmt.Fprintf(w, " (~%.2f)", float64(e.Uncached)*price)
+	}
+	fmt.Fprintln(w)
+}
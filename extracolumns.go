@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/ipinfo/go/v2/ipinfo"
+)
+
+// ipinfoAttributes are the ipinfo fields an "ipinfo:" extra column source
+// may name.
+var ipinfoAttributes = []string{"hostname", "city", "region", "country", "country_name", "loc", "postal", "timezone", "asn", "as_name", "as_domain", "as_type", "route"}
+
+// ipinfoFields flattens the attributes of info that extra columns can use.
+func ipinfoFields(info *ipinfo.Core) map[string]string {
+	fields := map[string]string{
+		"hostname":     info.Hostname,
+		"city":         info.City,
+		"region":       info.Region,
+		"country":      info.Country,
+		"country_name": info.CountryName,
+		"loc":          info.Location,
+		"postal":       info.Postal,
+		"timezone":     info.Timezone,
+	}
+	if info.ASN != nil {
+		fields["asn"] = info.ASN.ASN
+		fields["as_name"] = info.ASN.Name
+		fields["as_domain"] = info.ASN.Domain
+		fields["as_type"] = info.ASN.Type
+		fields["route"] = info.ASN.Route
+	}
+	return fields
+}
+
+var columnNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// builtinColumns are the columns of observationTableSchema, which extra
+// columns may not reuse.
+var builtinColumns = []string{"id", "timestamp", "cdn_ip", "hostname", "cdn_orgname", "stream_type", "account_name", "account_unit", "account_id", "prefix", "created_at", "updated_at", "outcome", "emulation_profile", "request_method", "resource_type", "cdn_providers", "multi_cdn", "matched_url", "websocket", "latency_ms", "time_to_first_segment_ms", "stream_type_source", "confidence", "alternatives", "tls_issuer"}
+
+// extraColumnDefinition is the type of every extra column.
+const extraColumnDefinition = `varchar(255) CHARACTER SET utf8 COLLATE utf8_general_ci DEFAULT NULL`
+
+// validateExtraColumn checks one ExtraColumns entry: a column name and a
+// source of "whois:<field>", "ipinfo:<attribute>" or "literal:<value>".
+func validateExtraColumn(column, source string) error {
+	if !columnNamePattern.MatchString(column) {
+		return fmt.Errorf("extra column %q is not a valid column name", column)
+	}
+	if slices.Contains(builtinColumns, strings.ToLower(column)) {
+		return fmt.Errorf("extra column %q clashes with a built-in column", column)
+	}
+
+	kind, arg, _ := strings.Cut(source, ":")
+	switch kind {
+	case "whois":
+		if arg == "" {
+			return fmt.Errorf("extra column %q: whois source needs a field name", column)
+		}
+	case "ipinfo":
+		if !slices.Contains(ipinfoAttributes, arg) {
+			return fmt.Errorf("extra column %q: unknown ipinfo attribute %q", column, arg)
+		}
+	case "literal":
+	default:
+		return fmt.Errorf("extra column %q: unknown source %q, expected whois:, ipinfo: or literal:", column, source)
+	}
+	return nil
+}
+
+// extraColumnValues resolves an account's extra columns for data. A source
+// the lookup didn't provide, e.g. an ipinfo attribute for an IP looked up
+// with whois, resolves to "".
+func extraColumnValues(columns map[string]string, data CdnShareData) map[string]string {
+	if len(columns) == 0 {
+		return nil
+	}
+
+	values := make(map[string]string, len(columns))
+	for column, source := range columns {
+		kind, arg, _ := strings.Cut(source, ":")
+		switch kind {
+		case "whois":
+			values[column] = parseWhois(data.ParsedWhois, []string{arg + ":"})
+		case "ipinfo":
+			values[column] = data.ipinfo[arg]
+		case "literal":
+			values[column] = arg
+		}
+	}
+	return values
+}
+
+// extraTableColumns returns the table columns for extra column values,
+// plus the extra columns of every other account writing to tableName, so a
+// table shared by accounts with different ExtraColumns has all of them.
+func extraTableColumns(tableName string, values map[string]string) []tableColumn {
+	columns := maps.Clone(values)
+	for _, a := range config.Accounts {
+		if a.DBTableName == tableName && len(a.ExtraColumns) > 0 {
+			if columns == nil {
+				columns = make(map[string]string)
+			}
+			maps.Copy(columns, a.ExtraColumns)
+		}
+	}
+
+	var out []tableColumn
+	for _, column := range slices.Sorted(maps.Keys(columns)) {
+		out = append(out, tableColumn{column, extraColumnDefinition})
+	}
+	return out
+}
+
+// warnSharedTableColumns logs tables shared by accounts whose ExtraColumns
+// differ. The table gets every account's extra columns, but each account's
+// rows leave the others' empty, which is rarely what was meant.
+func warnSharedTableColumns(accounts []Account) {
+	byTable := make(map[string][]Account)
+	for _, a := range accounts {
+		if a.DBTableName != "" {
+			byTable[a.DBTableName] = append(byTable[a.DBTableName], a)
+		}
+	}
+
+	for _, table := range slices.Sorted(maps.Keys(byTable)) {
+		sharing := byTable[table]
+		differ := slices.ContainsFunc(sharing[1:], func(a Account) bool {
+			return !maps.Equal(a.ExtraColumns, sharing[0].ExtraColumns)
+		})
+		if !differ {
+			continue
+		}
+		names := make([]string, len(sharing))
+		for i, a := range sharing {
+			names[i] = a.Name
+		}
+		slog.Warn("Accounts sharing a table have different extra columns", "table", table, "accounts", names)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDB is a database/sql driver that records the statements run against
+// it, so tests can check how the database is used without a server. Every
+// table exists, with no columns or indexes reported by information_schema.
+type fakeDB struct {
+	mu       sync.Mutex
+	queries  []string
+	prepared int
+	closed   int
+}
+
+// openFakeDB returns a *sql.DB backed by a new fakeDB.
+func openFakeDB(tb testing.TB) (*sql.DB, *fakeDB) {
+	tb.Helper()
+	f := new(fakeDB)
+	conn := sql.OpenDB(fakeConnector{f})
+	tb.Cleanup(func() { conn.Close() })
+	return conn, f
+}
+
+// count returns how many statements run so far contain substr.
+func (f *fakeDB) count(substr string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, q := range f.queries {
+		if strings.Contains(q, substr) {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeDB) record(query string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queries = append(f.queries, query)
+}
+
+type fakeConnector struct{ db *fakeDB }
+
+func (c fakeConnector) Connect(context.Context) (driver.Conn, error) { return fakeConn(c), nil }
+func (c fakeConnector) Driver() driver.Driver                        { return nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	c.db.mu.Lock()
+	c.db.prepared++
+	c.db.mu.Unlock()
+	return fakeStmt{c.db, query}, nil
+}
+
+func (c fakeConn) Close() error { return nil }
+
+func (c fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("fakeDB: transactions not supported")
+}
+
+func (c fakeConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	c.db.record(query)
+	return driver.RowsAffected(1), nil
+}
+
+func (c fakeConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	c.db.record(query)
+	if strings.Contains(query, "SELECT EXISTS") {
+		return &fakeRows{values: []driver.Value{true}}, nil
+	}
+	return &fakeRows{}, nil
+}
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s fakeStmt) Close() error {
+	s.db.mu.Lock()
+	s.db.closed++
+	s.db.mu.Unlock()
+	return nil
+}
+
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec([]driver.Value) (driver.Result, error) {
+	s.db.record(s.query)
+	return driver.RowsAffected(1), nil
+}
+
+func (s fakeStmt) Query([]driver.Value) (driver.Rows, error) {
+	s.db.record(s.query)
+	return &fakeRows{}, nil
+}
+
+// fakeRows is a single-column result holding values, one per row.
+type fakeRows struct {
+	values []driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return []string{"value"} }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	dest[0], r.values = r.values[0], r.values[1:]
+	return nil
+}
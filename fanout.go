@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync"
+)
+
+// lookupFlights deduplicates concurrent lookups of the same IP.
+var lookupFlights flightGroup
+
+// flightGroup runs one call per key at a time; callers arriving while it
+// is in flight wait for and share its result.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	data CdnShareData
+	err  error
+}
+
+// do runs fn for key, or waits for the call already running for key. shared
+// reports whether the result came from another caller's call.
+func (g *flightGroup) do(key string, fn func() (CdnShareData, error)) (data CdnShareData, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-c.done
+		return c.data, c.err, true
+	}
+	c := &flightCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.data, c.err = fn()
+	close(c.done)
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	return c.data, c.err, false
+}
+
+// ipLookup is the result of looking up one of a hostname's IPs.
+type ipLookup struct {
+	IP   net.IP
+	Data CdnShareData
+	Err  error
+}
+
+// whoAll looks up every IP of hostname with who, up to
+// lookup.ipConcurrency at a time, sharing the cache and in-flight lookups.
+// It returns the per-IP results in the order of ips and the distinct CDN
+// orgs found. IPs not yet started when ctx ends fail with its error, and
+// in-flight ones stop as their providers see ctx end.
+func whoAll(ctx context.Context, hostname string, ips []net.IP, providers []string) ([]ipLookup, []string) {
+	results := make([]ipLookup, len(ips))
+	slots := make(chan struct{}, max(config.Lookup.IPConcurrency, 1))
+
+	var wg sync.WaitGroup
+	for i, ip := range ips {
+		results[i].IP = ip
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			results[i].Err = ctx.Err()
+			continue
+		}
+		wg.Add(1)
+		go func(r *ipLookup) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			r.Data, r.Err = who(ctx, hostname, r.IP, providers)
+		}(&results[i])
+	}
+	wg.Wait()
+
+	var orgs []string
+	for _, r := range results {
+		if r.Err == nil && r.Data.CdnOrgName != "" && !slices.Contains(orgs, r.Data.CdnOrgName) {
+			orgs = append(orgs, r.Data.CdnOrgName)
+		}
+	}
+	return results, orgs
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// FingerprintRule names the CDN behind an edge when every condition it sets
+// holds, e.g. ASN 16509 with a cloudfront.net PTR is CloudFront while ASN
+// 16509 with an s3 CNAME is S3. Rules are tried from the highest Priority
+// down, in config order on ties, and the first match decides the CDN.
+type FingerprintRule struct {
+	// Name identifies the rule in detection signals. It defaults to CDN.
+	Name     string `json:"name"`
+	CDN      string `json:"cdn"`
+	Priority int    `json:"priority"`
+	// ASN matches if the edge's ASN is any of these, without the "AS".
+	ASN []string `json:"asn"`
+	// Org is a case-insensitive substring of, and OrgRegex a regular
+	// expression matched against, the org name from the lookup provider.
+	Org      string `json:"org"`
+	OrgRegex string `json:"orgRegex"`
+	// PTRSuffix and CNAMESuffix match the end of the edge IP's reverse DNS
+	// name and of the hostname's CNAME.
+	PTRSuffix   string `json:"ptrSuffix"`
+	CNAMESuffix string `json:"cnameSuffix"`
+	// Header must be present in the host's responses and, if
+	// HeaderContains is set, contain it (case-insensitively).
+	Header         string `json:"header"`
+	HeaderContains string `json:"headerContains"`
+}
+
+// fingerprintFacts are the signals a FingerprintRule is matched against.
+type fingerprintFacts struct {
+	asn     string
+	org     string
+	ptrs    []string
+	cname   string
+	headers map[string]string
+}
+
+type fingerprintRule struct {
+	FingerprintRule
+	orgRegex *regexp.Regexp
+}
+
+// compileFingerprintRules checks rules and sorts them into match order.
+func compileFingerprintRules(rules []FingerprintRule) ([]fingerprintRule, error) {
+	var errs []error
+	compiled := make([]fingerprintRule, 0, len(rules))
+	for i, r := range rules {
+		if r.CDN == "" {
+			errs = append(errs, fmt.Errorf("detection.rules[%d]: cdn is required", i))
+		}
+		if len(r.ASN) == 0 && r.Org == "" && r.OrgRegex == "" && r.PTRSuffix == "" && r.CNAMESuffix == "" && r.Header == "" {
+			errs = append(errs, fmt.Errorf("detection.rules[%d] (%s): at least one condition is required", i, r.CDN))
+		}
+		if r.HeaderContains != "" && r.Header == "" {
+			errs = append(errs, fmt.Errorf("detection.rules[%d] (%s): headerContains requires header", i, r.CDN))
+		}
+
+		rule := fingerprintRule{FingerprintRule: r}
+		if r.OrgRegex != "" {
+			re, err := regexp.Compile(r.OrgRegex)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("detection.rules[%d] (%s): %w", i, r.CDN, err))
+			}
+			rule.orgRegex = re
+		}
+		rule.Name = cmp.Or(rule.Name, rule.CDN)
+		rule.Header = strings.ToLower(rule.Header)
+		compiled = append(compiled, rule)
+	}
+
+	slices.SortStableFunc(compiled, func(a, b fingerprintRule) int {
+		return cmp.Compare(b.Priority, a.Priority)
+	})
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return compiled, nil
+}
+
+// fingerprints holds the compiled detection.rules. It is swapped whole when
+// watch mode reloads the config.
+var fingerprints atomic.Pointer[[]fingerprintRule]
+
+// fingerprintRules returns the current rules.
+func fingerprintRules() []fingerprintRule {
+	if p := fingerprints.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// matchFingerprint returns the first rule matching facts.
+func matchFingerprint(rules []fingerprintRule, facts fingerprintFacts) (fingerprintRule, bool) {
+	for _, r := range rules {
+		if r.matches(facts) {
+			return r, true
+		}
+	}
+	return fingerprintRule{}, false
+}
+
+func (r fingerprintRule) matches(f fingerprintFacts) bool {
+	if len(r.ASN) > 0 && !slices.Contains(r.ASN, f.asn) {
+		return false
+	}
+	if r.Org != "" && !strings.Contains(strings.ToLower(f.org), strings.ToLower(r.Org)) {
+		return false
+	}
+	if r.orgRegex != nil && !r.orgRegex.MatchString(f.org) {
+		return false
+	}
+	if r.PTRSuffix != "" && !slices.ContainsFunc(f.ptrs, func(ptr string) bool { return hasDNSSuffix(ptr, r.PTRSuffix) }) {
+		return false
+	}
+	if r.CNAMESuffix != "" && !hasDNSSuffix(f.cname, r.CNAMESuffix) {
+		return false
+	}
+	if r.Header != "" {
+		v, ok := f.headers[r.Header]
+		if !ok || !strings.Contains(strings.ToLower(v), strings.ToLower(r.HeaderContains)) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasDNSSuffix reports whether name ends with suffix, ignoring case and
+// trailing dots.
+func hasDNSSuffix(name, suffix string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	suffix = strings.ToLower(strings.TrimSuffix(suffix, "."))
+	return name != "" && strings.HasSuffix(name, suffix)
+}
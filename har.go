@@ -0,0 +1,281 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/network"
+)
+
+// harDir is set by the -har-dir flag.
+var harDir string
+
+// HAR 1.2 types. See http://www.softwareishard.com/blog/har-12-spec/.
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Pages   []harPage  `json:"pages"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harPage struct {
+	StartedDateTime time.Time      `json:"startedDateTime"`
+	ID              string         `json:"id"`
+	Title           string         `json:"title"`
+	PageTimings     map[string]any `json:"pageTimings"`
+}
+
+type harEntry struct {
+	Pageref         string      `json:"pageref"`
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Comment         string      `json:"comment,omitempty"`
+	// ResourceType is Chrome's resource type, a custom field also written
+	// by devtools' HAR export.
+	ResourceType string `json:"_resourceType,omitempty"`
+
+	// requestTime is the request's monotonic start, for computing the
+	// receive time once loading finishes.
+	requestTime time.Time
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []any          `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int64          `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []any          `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// harTimings are in milliseconds, with -1 for phases that don't apply.
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	SSL     float64 `json:"ssl"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// harRecorder collects the network events of one page load.
+type harRecorder struct {
+	mu      sync.Mutex
+	started time.Time
+	entries []*harEntry
+	byID    map[network.RequestID]*harEntry
+}
+
+func newHARRecorder() *harRecorder {
+	return &harRecorder{started: time.Now(), byID: make(map[network.RequestID]*harEntry)}
+}
+
+func (h *harRecorder) request(ev *network.EventRequestWillBeSent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// A redirect reuses the request ID; its response ends the previous entry.
+	if prev, ok := h.byID[ev.RequestID]; ok && ev.RedirectResponse != nil {
+		prev.Response = harResponseFrom(ev.RedirectResponse)
+		prev.Response.RedirectURL = ev.Request.URL
+	}
+
+	e := &harEntry{
+		Pageref: "page_1",
+		Request: harRequest{
+			Method:      ev.Request.Method,
+			URL:         ev.Request.URL,
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []any{},
+			Headers:     harHeaders(ev.Request.Headers),
+			QueryString: harQueryString(ev.Request.URL),
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Response: harResponse{Cookies: []any{}, Headers: []harNameValue{}, HeadersSize: -1, BodySize: -1},
+		Timings:  harTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1, Send: 0, Wait: 0, Receive: 0},
+
+		ResourceType: string(ev.Type),
+	}
+	if ev.WallTime != nil {
+		e.StartedDateTime = ev.WallTime.Time()
+	}
+	if ev.Timestamp != nil {
+		e.requestTime = ev.Timestamp.Time()
+	}
+	h.entries = append(h.entries, e)
+	h.byID[ev.RequestID] = e
+}
+
+func (h *harRecorder) response(ev *network.EventResponseReceived) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	e, ok := h.byID[ev.RequestID]
+	if !ok {
+		return
+	}
+	e.Response = harResponseFrom(ev.Response)
+	e.ServerIPAddress = ev.Response.RemoteIPAddress
+	e.Request.HTTPVersion = e.Response.HTTPVersion
+
+	if t := ev.Response.Timing; t != nil {
+		e.Timings = harTimings{
+			Blocked: -1,
+			DNS:     harPhase(t.DNSStart, t.DNSEnd),
+			Connect: harPhase(t.ConnectStart, t.ConnectEnd),
+			SSL:     harPhase(t.SslStart, t.SslEnd),
+			Send:    max(t.SendEnd-t.SendStart, 0),
+			Wait:    max(t.ReceiveHeadersEnd-t.SendEnd, 0),
+		}
+		// Timing offsets are relative to RequestTime, in seconds on the
+		// same monotonic clock as event timestamps.
+		e.requestTime = cdp.MonotonicTimeEpoch.Add(time.Duration(t.RequestTime * float64(time.Second)))
+		e.Time = t.ReceiveHeadersEnd
+	}
+}
+
+func (h *harRecorder) finished(ev *network.EventLoadingFinished) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	e, ok := h.byID[ev.RequestID]
+	if !ok || ev.Timestamp == nil || e.requestTime.IsZero() {
+		return
+	}
+	total := float64(ev.Timestamp.Time().Sub(e.requestTime)) / float64(time.Millisecond)
+	if total > e.Time {
+		e.Timings.Receive = total - e.Time
+		e.Time = total
+	}
+	e.Response.BodySize = int(ev.EncodedDataLength)
+}
+
+func (h *harRecorder) failed(ev *network.EventLoadingFailed) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if e, ok := h.byID[ev.RequestID]; ok {
+		e.Comment = ev.ErrorText
+	}
+}
+
+// write saves the recorded page load of c as a HAR file in harDir.
+func (h *harRecorder) write(c *capture) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	log := harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "cdnshare", Version: "1.0"},
+		Pages: []harPage{{
+			StartedDateTime: h.started,
+			ID:              "page_1",
+			Title:           c.url,
+			PageTimings:     map[string]any{},
+		}},
+		Entries: make([]harEntry, 0, len(h.entries)),
+	}
+	for _, e := range h.entries {
+		log.Entries = append(log.Entries, *e)
+	}
+
+	b, err := json.MarshalIndent(map[string]harLog{"log": log}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(harDir, 0777); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(harDir, captureFileName(c, h.started, ".har")), b, 0666)
+}
+
+func harResponseFrom(r *network.Response) harResponse {
+	return harResponse{
+		Status:      r.Status,
+		StatusText:  r.StatusText,
+		HTTPVersion: cmp.Or(strings.ToUpper(r.Protocol), "HTTP/1.1"),
+		Cookies:     []any{},
+		Headers:     harHeaders(r.Headers),
+		Content:     harContent{Size: -1, MimeType: r.MimeType},
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+}
+
+// harPhase returns the length of a timing phase, or -1 if it didn't happen.
+func harPhase(start, end float64) float64 {
+	if start < 0 || end < 0 {
+		return -1
+	}
+	return end - start
+}
+
+func harHeaders(h network.Headers) []harNameValue {
+	out := make([]harNameValue, 0, len(h))
+	for name, v := range h {
+		out = append(out, harNameValue{Name: name, Value: fmt.Sprint(v)})
+	}
+	slices.SortFunc(out, func(a, b harNameValue) int { return cmp.Compare(a.Name, b.Name) })
+	return out
+}
+
+func harQueryString(raw string) []harNameValue {
+	out := []harNameValue{}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return out
+	}
+	for name, values := range u.Query() {
+		for _, v := range values {
+			out = append(out, harNameValue{Name: name, Value: v})
+		}
+	}
+	slices.SortStableFunc(out, func(a, b harNameValue) int { return cmp.Compare(a.Name, b.Name) })
+	return out
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/network"
+)
+
+func TestHARRecorderTimings(t *testing.T) {
+	h := newHARRecorder()
+
+	// Chrome's monotonic clock, in seconds since cdp.MonotonicTimeEpoch.
+	const requestTime = 12345.5
+	sent := cdp.MonotonicTime(cdp.MonotonicTimeEpoch.Add(time.Duration(requestTime * float64(time.Second))))
+	done := cdp.MonotonicTime(time.Time(sent).Add(200 * time.Millisecond))
+
+	h.request(&network.EventRequestWillBeSent{
+		RequestID: "1",
+		Request:   &network.Request{URL: "https://cdn.example.com/seg1.ts", Method: "GET"},
+		Timestamp: &sent,
+	})
+	h.response(&network.EventResponseReceived{
+		RequestID: "1",
+		Response: &network.Response{
+			URL:    "https://cdn.example.com/seg1.ts",
+			Status: 200,
+			Timing: &network.ResourceTiming{
+				RequestTime:       requestTime,
+				SendStart:         1,
+				SendEnd:           2,
+				ReceiveHeadersEnd: 50,
+			},
+		},
+	})
+	h.finished(&network.EventLoadingFinished{RequestID: "1", Timestamp: &done, EncodedDataLength: 1000})
+
+	e := h.entries[0]
+	if e.Time < 199 || e.Time > 201 {
+		t.Errorf("time = %v ms, want about 200", e.Time)
+	}
+	if e.Timings.Receive < 149 || e.Timings.Receive > 151 {
+		t.Errorf("receive = %v ms, want about 150", e.Timings.Receive)
+	}
+	if e.Timings.Wait != 48 {
+		t.Errorf("wait = %v ms, want 48", e.Timings.Wait)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// cacheLoaded is set once loadCache has completed, and is part of readiness.
+var cacheLoaded atomic.Bool
+
+// startHealthServer serves /healthz and /readyz on addr in the background.
+func startHealthServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+
+	go func() {
+		slog.Info("Starting health server", "addr", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("Health server stopped", "addr", addr, "error", err)
+		}
+	}()
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if !cacheLoaded.Load() {
+		http.Error(w, "cache not loaded", http.StatusServiceUnavailable)
+		return
+	}
+
+	if db == nil {
+		fmt.Fprintln(w, "ok")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	if err := db.PingContext(ctx); err != nil {
+		slog.Warn("Readiness check failed", "error", err)
+		http.Error(w, "database unreachable", http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
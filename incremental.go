@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultIncrementalStateFile = "incremental_state.json"
+
+// incrementalState remembers when each (account, URL, stream type) last
+// produced observations, so fresh ones can be skipped in incremental mode.
+type incrementalState struct {
+	mu     sync.Mutex
+	path   string
+	maxAge time.Duration
+	seen   map[string]time.Time
+}
+
+// loadIncrementalState reads the state file at path. A zero maxAge disables
+// incremental mode and no file is read or written.
+func loadIncrementalState(path string, maxAge time.Duration) (*incrementalState, error) {
+	if path == "" {
+		path = defaultIncrementalStateFile
+	}
+	s := &incrementalState{path: path, maxAge: maxAge, seen: make(map[string]time.Time)}
+	if maxAge <= 0 {
+		return s, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, json.Unmarshal(b, &s.seen)
+}
+
+func incrementalKey(account Account, url, streamType string) string {
+	return account.Name + "|" + account.Unit + "|" + streamType + "|" + url
+}
+
+// fresh reports whether key succeeded within the freshness window.
+func (s *incrementalState) fresh(key string) bool {
+	if s.maxAge <= 0 {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last, ok := s.seen[key]
+	return ok && time.Since(last) < s.maxAge
+}
+
+func (s *incrementalState) done(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seen[key] = time.Now()
+}
+
+func (s *incrementalState) save() error {
+	if s.maxAge <= 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := json.MarshalIndent(s.seen, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, b, 0666)
+}
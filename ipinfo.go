@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipinfo/go/v2/ipinfo"
+)
+
+var errNoIPInfoTokens = errors.New("all ipinfo tokens are exhausted")
+
+// tokenPool hands out ipinfo clients round-robin and retires tokens that
+// hit their rate limit or quota for the rest of the run.
+type tokenPool struct {
+	mu        sync.Mutex
+	tokens    []string
+	clients   map[string]*ipinfo.Client
+	next      int
+	exhausted map[string]bool
+	usage     map[string]int
+}
+
+// newTokenPool builds a pool from tokens, falling back to IPINFO_TOKEN when
+// none are configured.
+func newTokenPool(tokens []string) *tokenPool {
+	if len(tokens) == 0 {
+		tokens = []string{IPINFO_TOKEN}
+	}
+
+	p := &tokenPool{
+		tokens:    tokens,
+		clients:   make(map[string]*ipinfo.Client),
+		exhausted: make(map[string]bool),
+		usage:     make(map[string]int),
+	}
+	for _, t := range tokens {
+		p.clients[t] = ipinfo.NewClient(nil, nil, t)
+	}
+	return p
+}
+
+// pick returns the next usable token and its client.
+func (p *tokenPool) pick() (string, *ipinfo.Client, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for range p.tokens {
+		t := p.tokens[p.next%len(p.tokens)]
+		p.next++
+		if !p.exhausted[t] {
+			p.usage[t]++
+			return t, p.clients[t], true
+		}
+	}
+	return "", nil, false
+}
+
+func (p *tokenPool) retire(token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.exhausted[token] = true
+}
+
+// Usage returns lookups per token, keyed by a masked form of the token.
+func (p *tokenPool) Usage() map[string]int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	usage := make(map[string]int, len(p.usage))
+	for t, n := range p.usage {
+		usage[maskToken(t)] = n
+	}
+	return usage
+}
+
+// maskToken keeps only the last four characters of a token.
+func maskToken(t string) string {
+	if len(t) <= 4 {
+		return strings.Repeat("*", len(t))
+	}
+	return strings.Repeat("*", len(t)-4) + t[len(t)-4:]
+}
+
+// isQuotaError reports whether err means the token is rate limited or out
+// of quota.
+func isQuotaError(err error) bool {
+	var resp *ipinfo.ErrorResponse
+	if errors.As(err, &resp) && resp.Response != nil {
+		return resp.Response.StatusCode == http.StatusTooManyRequests || resp.Response.StatusCode == http.StatusForbidden
+	}
+	return strings.Contains(err.Error(), "429") || strings.Contains(strings.ToLower(err.Error()), "quota")
+}
+
+// lookupIPInfo queries ipinfo for ip, moving on to the next token whenever
+// one is rate limited or out of quota.
+func lookupIPInfo(ip net.IP) (*ipinfo.Core, error) {
+	for {
+		token, client, ok := ipinfoTokens.pick()
+		if !ok {
+			return nil, errNoIPInfoTokens
+		}
+
+		info, err := client.GetIPInfo(ip)
+		if err != nil && isQuotaError(err) {
+			ipinfoTokens.retire(token)
+			continue
+		}
+		return info, err
+	}
+}
+
+// lookupIPInfoOrg looks up the CDN org for ip with ipinfo. The ipinfo client
+// takes no context, so ctx only bounds the wait for the rate limiter.
+func lookupIPInfoOrg(ctx context.Context, hostname string, ip net.IP) (CdnShareData, error) {
+	if err := lookupLimiter.Wait(ctx); err != nil {
+		return CdnShareData{}, err
+	}
+
+	lookupsTotal.WithLabelValues("ipinfo").Inc()
+	info, err := lookupIPInfo(ip)
+	if err != nil {
+		return CdnShareData{}, err
+	}
+
+	prettyName := prettyCdnOrgName(info.Org)
+	var prefix string
+	if info.ASN != nil {
+		// Only returned on plans that include ASN details.
+		prefix = info.ASN.Route
+	}
+
+	fields := ipinfoFields(info)
+
+	cachePut(ip, WhoisCacheData{
+		Timestamp:   time.Now(),
+		CdnOrgName:  prettyName,
+		ParsedWhois: info.Org,
+		Prefix:      prefix,
+		IPInfo:      fields,
+		Provider:    "ipinfo",
+	})
+	slog.Debug("Looked up CDN org", "provider", "ipinfo", "hostname", hostname, "ip", ip.String(), "cdn_org", prettyName)
+	return CdnShareData{
+		Timestamp:        observationTime(),
+		CdnIp:            ip.String(),
+		CustomerHostname: hostname,
+		CdnOrgName:       prettyName,
+		ParsedWhois:      info.Org,
+		Prefix:           prefix,
+		ipinfo:           fields,
+	}, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// LatencyConfig configures the optional RTT probe to each CDN edge.
+type LatencyConfig struct {
+	Enabled bool `json:"enabled"`
+	// Method is "tcp" (the default), which times a TCP connect to Port and
+	// needs no privileges, or "icmp", which sends echo requests over an
+	// unprivileged ICMP socket (net.ipv4.ping_group_range), falling back to
+	// a raw socket, which needs root or CAP_NET_RAW.
+	Method    string `json:"method"`
+	Port      int    `json:"port"`
+	Samples   int    `json:"samples"`
+	TimeoutMs int    `json:"timeoutMs"`
+}
+
+// probeLatency returns the median of config.Latency.Samples round trips to
+// ip. It fails only if every sample fails.
+func probeLatency(ip net.IP) (time.Duration, error) {
+	cfg := config.Latency
+	timeout := time.Duration(cfg.TimeoutMs) * time.Millisecond
+
+	var samples []time.Duration
+	var lastErr error
+	for range cfg.Samples {
+		var d time.Duration
+		var err error
+		if cfg.Method == "icmp" {
+			d, err = icmpEchoTime(ip, timeout)
+		} else {
+			d, err = tcpConnectTime(ip, cfg.Port, timeout)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		samples = append(samples, d)
+	}
+
+	if len(samples) == 0 {
+		return 0, lastErr
+	}
+	slices.Sort(samples)
+	return samples[len(samples)/2], nil
+}
+
+func tcpConnectTime(ip net.IP, port int, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)), timeout)
+	if err != nil {
+		return 0, err
+	}
+	d := time.Since(start)
+	conn.Close()
+	return d, nil
+}
+
+var icmpSeq atomic.Uint32
+
+func icmpEchoTime(ip net.IP, timeout time.Duration) (time.Duration, error) {
+	network, rawNetwork, address, proto := "udp4", "ip4:icmp", "0.0.0.0", 1
+	var request, reply icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	if ip.To4() == nil {
+		network, rawNetwork, address, proto = "udp6", "ip6:ipv6-icmp", "::", 58
+		request, reply = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+
+	var dst net.Addr = &net.UDPAddr{IP: ip}
+	conn, err := icmp.ListenPacket(network, address)
+	raw := false
+	if err != nil {
+		// Ping sockets are disabled for this group; a raw socket works
+		// when running as root or with CAP_NET_RAW.
+		rawConn, rawErr := icmp.ListenPacket(rawNetwork, address)
+		if rawErr != nil {
+			return 0, fmt.Errorf("error opening ICMP socket: %w", errors.Join(err, rawErr))
+		}
+		conn, raw, dst = rawConn, true, &net.IPAddr{IP: ip}
+	}
+	defer conn.Close()
+
+	id, seq := os.Getpid()&0xffff, int(icmpSeq.Add(1)&0xffff)
+	msg := icmp.Message{
+		Type: request,
+		Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("cdnshare")},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	if _, err := conn.WriteTo(b, dst); err != nil {
+		return 0, err
+	}
+
+	conn.SetReadDeadline(start.Add(timeout))
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return 0, err
+		}
+		m, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil {
+			continue
+		}
+		// Unprivileged sockets rewrite the echo ID, so it is only checked
+		// on a raw socket, which also receives other processes' replies.
+		if echo, ok := m.Body.(*icmp.Echo); ok && m.Type == reply && echo.Seq == seq && (!raw || echo.ID == id) {
+			return time.Since(start), nil
+		}
+	}
+}
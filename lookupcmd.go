@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+// lookupResult is one IP's answer from the lookup subcommand.
+type lookupResult struct {
+	Hostname string `json:"hostname,omitempty"`
+	IP       string `json:"ip"`
+	Org      string `json:"org,omitempty"`
+	CDN      string `json:"cdn_orgname,omitempty"`
+	ASN      string `json:"asn,omitempty"`
+	Prefix   string `json:"prefix,omitempty"`
+	Whois    string `json:"whois,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// runLookup implements the lookup subcommand: it looks up the CDN serving
+// each hostname or IP argument, without any accounts, through the same
+// providers and cache as a collection run.
+func runLookup(args []string) int {
+	fs := flag.NewFlagSet("lookup", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the results as JSON")
+	fs.StringVar(&cacheFlag, "cache", "", "use this cache file, overriding cache.file and cache.namespace")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: cdnshare lookup [flags] <hostname or IP>...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitConfigError
+	}
+
+	err := setup()
+	if err != nil {
+		slog.Error("Error loading config", "error", err)
+		return exitConfigError
+	}
+
+	collector, err := NewCollector(config, new(memorySink))
+	if err != nil {
+		fatal("Error starting collector", "error", err)
+	}
+	defer collector.Close()
+
+	// Header detection needs a page load, so a bare hostname falls back to
+	// the providers.
+	providers := config.Lookup.Providers
+	if method := config.Lookup.DetectionMethod; method != "auto" && method != "headers" {
+		providers = []string{method}
+	}
+
+	// Ctrl-C abandons lookups still in flight.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var results []lookupResult
+	orgs := make(map[string][]string)
+	for _, target := range fs.Args() {
+		r, targetOrgs := lookupTarget(ctx, target, providers)
+		results = append(results, r...)
+		orgs[target] = targetOrgs
+	}
+
+	if err := saveCache(); err != nil {
+		fatal("Error saving cache", "error", err, "path", cacheFile)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(results)
+	} else {
+		err = printLookupResults(os.Stdout, results, orgs)
+	}
+	if err != nil {
+		fatal("Error printing results", "error", err)
+	}
+
+	for _, r := range results {
+		if r.Error != "" {
+			return exitPartialFailure
+		}
+	}
+	return exitOK
+}
+
+// lookupTarget looks up target, an IP or a hostname whose every address is
+// looked up concurrently, and returns the results with the distinct CDN
+// orgs found.
+func lookupTarget(ctx context.Context, target string, providers []string) ([]lookupResult, []string) {
+	var hostname string
+	ips := []net.IP{net.ParseIP(target)}
+	if ips[0] == nil {
+		var err error
+		hostname = target
+		ips, err = net.DefaultResolver.LookupIP(ctx, "ip", target)
+		if err != nil {
+			return []lookupResult{{Hostname: target, Error: err.Error()}}, nil
+		}
+	}
+
+	lookups, orgs := whoAll(ctx, hostname, ips, providers)
+	results := make([]lookupResult, len(lookups))
+	for i, l := range lookups {
+		results[i] = lookupResultOf(hostname, l)
+	}
+	return results, orgs
+}
+
+func lookupResultOf(hostname string, l ipLookup) lookupResult {
+	r := lookupResult{Hostname: hostname, IP: l.IP.String()}
+	if l.Err != nil {
+		r.Error = l.Err.Error()
+		return r
+	}
+
+	r.CDN = l.Data.CdnOrgName
+	r.Org = rawOrgName(l.Data.ParsedWhois)
+	r.Prefix = l.Data.Prefix
+	r.Whois = l.Data.ParsedWhois
+	if m := asnPattern.FindStringSubmatch(l.Data.ParsedWhois); m != nil {
+		r.ASN = m[0]
+	}
+	return r
+}
+
+// rawOrgName returns the org named by a provider's raw answer, before
+// pretty name mapping: the org field of WHOIS output, or the AS name of
+// ipinfo's and Team Cymru's "AS<n> <name>" answers.
+func rawOrgName(parsed string) string {
+	if org := strings.TrimSpace(parseWhois(parsed, defaultWhoisFields)); org != "" {
+		return org
+	}
+	org, _, _ := strings.Cut(parsed, " | ")
+	if m := asnPattern.FindStringIndex(org); m != nil && m[0] == 0 {
+		org = org[m[1]:]
+	}
+	return strings.TrimSpace(org)
+}
+
+// printLookupResults prints results, with the CDN orgs found for each
+// hostname target.
+func printLookupResults(out io.Writer, results []lookupResult, orgs map[string][]string) error {
+	w := bufio.NewWriter(out)
+	for i, r := range results {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "Hostname: %s\n", cmp.Or(r.Hostname, "-"))
+		first := i == 0 || results[i-1].Hostname != r.Hostname
+		if hostOrgs := orgs[r.Hostname]; first && r.Hostname != "" && len(hostOrgs) > 0 {
+			fmt.Fprintf(w, "All IPs:  %s\n", strings.Join(hostOrgs, ", "))
+		}
+		fmt.Fprintf(w, "IP:       %s\n", cmp.Or(r.IP, "-"))
+		if r.Error != "" {
+			fmt.Fprintf(w, "Error:    %s\n", r.Error)
+			continue
+		}
+		fmt.Fprintf(w, "CDN org:  %s\n", cmp.Or(r.CDN, "-"))
+		fmt.Fprintf(w, "Org:      %s\n", cmp.Or(r.Org, "-"))
+		fmt.Fprintf(w, "ASN:      %s\n", cmp.Or(r.ASN, "-"))
+		fmt.Fprintf(w, "Prefix:   %s\n", cmp.Or(r.Prefix, "-"))
+		if r.Whois != "" {
+			fmt.Fprintf(w, "\n%s\n", strings.TrimRight(r.Whois, "\n"))
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"container/list"
+	"slices"
+	"sync"
+	"time"
+)
+
+// whoisLRU is a concurrency-safe WHOIS cache keyed by IP. When maxEntries is
+// positive it holds at most that many entries, evicting the least recently
+// used IP first.
+type whoisLRU struct {
+	mu         sync.Mutex
+	maxEntries int
+	ll         *list.List
+	items      map[string]*list.Element
+}
+
+type lruEntry struct {
+	key  string
+	data WhoisCacheData
+}
+
+func newWhoisLRU(maxEntries int) *whoisLRU {
+	return &whoisLRU{
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+// Get returns the entry for key and marks it as recently used.
+func (c *whoisLRU) Get(key string) (WhoisCacheData, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return WhoisCacheData{}, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*lruEntry).data, true
+}
+
+// Put adds or replaces the entry for key, evicting old entries if needed.
+func (c *whoisLRU) Put(key string, data WhoisCacheData) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		el.Value.(*lruEntry).data = data
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&lruEntry{key: key, data: data})
+	for c.maxEntries > 0 && c.ll.Len() > c.maxEntries {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (c *whoisLRU) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// snapshot returns a copy of the live entries.
+func (c *whoisLRU) snapshot() map[string]WhoisCacheData {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m := make(map[string]WhoisCacheData, len(c.items))
+	for key, el := range c.items {
+		m[key] = el.Value.(*lruEntry).data
+	}
+	return m
+}
+
+// removeOlderThan removes the entries looked up before cutoff and returns
+// how many there were.
+func (c *whoisLRU) removeOlderThan(cutoff time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for key, el := range c.items {
+		if el.Value.(*lruEntry).data.Timestamp.Before(cutoff) {
+			c.ll.Remove(el)
+			delete(c.items, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// load adds entries oldest first by Timestamp, so that recency after a
+// restart follows when each IP was looked up.
+func (c *whoisLRU) load(m map[string]WhoisCacheData) {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		return m[a].Timestamp.Compare(m[b].Timestamp)
+	})
+
+	for _, key := range keys {
+		c.Put(key, m[key])
+	}
+}
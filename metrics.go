@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	lookupsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdnshare_lookups_total",
+		Help: "CDN org lookups performed, by detection method.",
+	}, []string{"method"})
+
+	cacheHitsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cdnshare_cache_hits_total",
+		Help: "WHOIS cache hits.",
+	})
+
+	cacheMissesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cdnshare_cache_misses_total",
+		Help: "WHOIS cache misses.",
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "cdnshare_cache_hit_ratio",
+		Help: "Ratio of WHOIS cache hits to total cache lookups in the current run.",
+	}, func() float64 {
+		r := stats.snapshot()
+		if total := r.CacheHits + r.CacheMisses; total > 0 {
+			return float64(r.CacheHits) / float64(total)
+		}
+		return 0
+	})
+
+	dbInsertsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cdnshare_db_inserts_total",
+		Help: "Rows inserted into the database.",
+	})
+
+	dbInsertErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cdnshare_db_insert_errors_total",
+		Help: "Failed database inserts.",
+	})
+
+	cdnObservationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdnshare_cdn_observations_total",
+		Help: "Observed media requests, by CDN org.",
+	}, []string{"cdn_org"})
+
+	navigationFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cdnshare_navigation_failures_total",
+		Help: "Chrome navigations that failed.",
+	})
+
+	providerCircuitState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cdnshare_provider_circuit_state",
+		Help: "Lookup provider circuit breaker state: 0 closed, 1 open, 2 half-open.",
+	}, []string{"provider"})
+)
+
+// startMetricsServer serves /metrics on addr in the background.
+func startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		slog.Info("Starting metrics server", "addr", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("Metrics server stopped", "addr", addr, "error", err)
+		}
+	}()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// tableColumn is a column added to a table after its original schema.
+type tableColumn struct {
+	name       string
+	definition string
+}
+
+// tableIndex is a hash index added to a table after its original schema.
+type tableIndex struct {
+	name    string
+	columns string
+}
+
+// Definitions of the columns added to account tables after their original
+// schema.
+const (
+	prefixColumn    = `varchar(64) CHARACTER SET utf8 COLLATE utf8_general_ci DEFAULT NULL`
+	createdAtColumn = `timestamp DEFAULT CURRENT_TIMESTAMP`
+	updatedAtColumn = `timestamp DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP`
+	outcomeColumn   = `varchar(32) CHARACTER SET utf8 COLLATE utf8_general_ci DEFAULT NULL`
+
+	emulationProfileColumn   = `varchar(255) CHARACTER SET utf8 COLLATE utf8_general_ci DEFAULT NULL`
+	requestMethodColumn      = `varchar(16) CHARACTER SET utf8 COLLATE utf8_general_ci DEFAULT NULL`
+	resourceTypeColumn       = `varchar(32) CHARACTER SET utf8 COLLATE utf8_general_ci DEFAULT NULL`
+	cdnProvidersColumn       = `varchar(1024) CHARACTER SET utf8 COLLATE utf8_general_ci DEFAULT NULL`
+	multiCDNColumn           = `tinyint(1) NOT NULL DEFAULT 0`
+	matchedURLColumn         = `text CHARACTER SET utf8 COLLATE utf8_general_ci`
+	webSocketColumn          = `tinyint(1) NOT NULL DEFAULT 0`
+	latencyMsColumn          = `double DEFAULT NULL`
+	timeToFirstSegmentColumn = `bigint(20) DEFAULT NULL`
+	streamTypeSourceColumn   = `varchar(16) CHARACTER SET utf8 COLLATE utf8_general_ci DEFAULT NULL`
+	confidenceColumn         = `double DEFAULT NULL`
+	alternativesColumn       = `text CHARACTER SET utf8 COLLATE utf8_general_ci`
+	tlsIssuerColumn          = `varchar(255) CHARACTER SET utf8 COLLATE utf8_general_ci DEFAULT NULL`
+)
+
+// hostnameIndex serves per-hostname lookups such as the latest view of the
+// query subcommand. On a columnstore table it is a secondary hash index,
+// which only helps equality on all its columns, so it covers hostname alone:
+// timestamp ranges are left to the columnstore sort key (see
+// observationSchema). On InnoDB, USING HASH is ignored and it is a regular
+// B-tree index.
+const (
+	hostnameIndex        = "hostname"
+	hostnameIndexColumns = `("hostname")`
+)
+
+// observationColumns and observationIndexes are added to account tables
+// created before they were part of observationTableSchema. New entries go
+// at the end, and must also be added to the schema.
+var (
+	observationColumns = []tableColumn{
+		{"prefix", prefixColumn},
+		{"created_at", createdAtColumn},
+		{"updated_at", updatedAtColumn},
+		{"outcome", outcomeColumn},
+		{"emulation_profile", emulationProfileColumn},
+		{"request_method", requestMethodColumn},
+		{"resource_type", resourceTypeColumn},
+		{"cdn_providers", cdnProvidersColumn},
+		{"multi_cdn", multiCDNColumn},
+		{"matched_url", matchedURLColumn},
+		{"websocket", webSocketColumn},
+		{"latency_ms", latencyMsColumn},
+		{"time_to_first_segment_ms", timeToFirstSegmentColumn},
+		{"stream_type_source", streamTypeSourceColumn},
+		{"confidence", confidenceColumn},
+		{"alternatives", alternativesColumn},
+		{"tls_issuer", tlsIssuerColumn},
+	}
+	observationIndexes = []tableIndex{
+		{hostnameIndex, hostnameIndexColumns},
+	}
+)
+
+// migratedTables records the tables, and sets of columns, already migrated
+// by this process.
+var migratedTables sync.Map
+
+// migrateTable adds whichever of columns and indexes tableName is missing.
+// It only issues ALTER TABLE for what information_schema says is absent,
+// so it is safe to run repeatedly, and each table is checked once per run
+// for each set of columns asked for.
+func migrateTable(db *sql.DB, tableName string, columns []tableColumn, indexes []tableIndex) error {
+	key := tableName
+	for _, c := range columns {
+		key += " " + c.name
+	}
+	if _, ok := migratedTables.Load(key); ok {
+		return nil
+	}
+
+	existing, err := existingNames(db, tableName, `SELECT column_name FROM information_schema.columns WHERE table_schema = ? AND table_name = ?`)
+	if err != nil {
+		return err
+	}
+	for _, c := range columns {
+		if existing[c.name] {
+			continue
+		}
+		_, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN "%s" %s`, tableName, c.name, c.definition))
+		if err != nil {
+			return fmt.Errorf("error adding column %s: %w", c.name, err)
+		}
+		slog.Info("Added column", "table", tableName, "column", c.name)
+	}
+
+	existing, err = existingNames(db, tableName, `SELECT DISTINCT index_name FROM information_schema.statistics WHERE table_schema = ? AND table_name = ?`)
+	if err != nil {
+		return err
+	}
+	for _, ix := range indexes {
+		if existing[ix.name] {
+			continue
+		}
+		_, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD KEY "%s" %s USING HASH`, tableName, ix.name, ix.columns))
+		if err != nil {
+			return fmt.Errorf("error adding index %s: %w", ix.name, err)
+		}
+		slog.Info("Added index", "table", tableName, "index", ix.name)
+	}
+
+	migratedTables.Store(key, true)
+	return nil
+}
+
+// existingNames runs an information_schema query for tableName and returns
+// the names it lists.
+func existingNames(db *sql.DB, tableName, query string) (map[string]bool, error) {
+	rows, err := db.Query(query, config.Database.Database, tableName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names[name] = true
+	}
+	return names, rows.Err()
+}
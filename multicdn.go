@@ -0,0 +1,82 @@
+package main
+
+import (
+	"cmp"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// multiCDNKey groups a capture's observations of one hostname and stream
+// type.
+type multiCDNKey struct {
+	hostname   string
+	streamType string
+}
+
+// noteProvider adds cdnOrg to the CDN orgs seen serving hostname and
+// streamType in this capture. Platforms that load-balance segments across
+// CDNs end up with more than one.
+func (c *capture) noteProvider(hostname, streamType, cdnOrg string) {
+	cdnOrg = strings.TrimSpace(cdnOrg)
+	if cdnOrg == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.providers == nil {
+		c.providers = make(map[multiCDNKey]map[string]struct{})
+	}
+	key := multiCDNKey{hostname, streamType}
+	if c.providers[key] == nil {
+		c.providers[key] = make(map[string]struct{})
+	}
+	c.providers[key][cdnOrg] = struct{}{}
+}
+
+// reportMultiCDN writes a providers row for each hostname and stream type
+// the capture observed, with every CDN org seen serving it, once the
+// capture has ended. Rows written during the capture can't carry the set,
+// since a second CDN may only show up later. Multi-CDN hostnames are also
+// logged.
+func (c *capture) reportMultiCDN() {
+	c.mu.Lock()
+	providers := make(map[multiCDNKey][]string, len(c.providers))
+	for key, orgs := range c.providers {
+		providers[key] = slices.Sorted(maps.Keys(orgs))
+	}
+	c.mu.Unlock()
+
+	timestamp := observationTime()
+	if !c.replayTime.IsZero() {
+		timestamp = c.replayTime.In(timestampLocation)
+	}
+	for _, key := range slices.SortedFunc(maps.Keys(providers), func(a, b multiCDNKey) int {
+		return cmp.Or(strings.Compare(a.hostname, b.hostname), strings.Compare(a.streamType, b.streamType))
+	}) {
+		orgs := providers[key]
+		if len(orgs) > 1 {
+			slog.Info("Multi-CDN delivery", "account", c.account.Name, "url", c.url, "hostname", key.hostname, "stream_type", key.streamType, "cdn_orgs", orgs)
+		}
+
+		data := CdnShareData{
+			Timestamp:          timestamp,
+			CustomerHostname:   key.hostname,
+			CustomerStreamType: key.streamType,
+			AccountName:        c.account.Name,
+			AccountUnit:        c.account.Unit,
+			AccountID:          c.account.ID,
+			Outcome:            outcomeProviders,
+			CdnProviders:       strings.Join(orgs, ","),
+			MultiCDN:           len(orgs) > 1,
+			EmulationProfile:   c.account.emulation().profileName(),
+			table:              c.account.DBTableName,
+		}
+		if err := sink.Write(data); err != nil {
+			stats.error()
+			slog.Error("Error saving providers row", "account", c.account.Name, "url", c.url, "hostname", key.hostname, "error", err)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errRecentlyFailed is returned for IPs whose lookup failed within the
+// negative cache TTL.
+var errRecentlyFailed = errors.New("lookup failed recently, not retrying yet")
+
+// failedLookups remembers IPs whose lookup failed, so following segments for
+// the same IP don't retry a failing lookup straight away. It is kept in
+// memory only, separate from the WHOIS cache, which holds successes.
+var failedLookups = &negativeCache{until: make(map[string]time.Time)}
+
+type negativeCache struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+// add marks key as failed for ttl.
+func (n *negativeCache) add(key string, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.until[key] = time.Now().Add(ttl)
+}
+
+// failed reports whether key failed within its TTL.
+func (n *negativeCache) failed(key string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	until, ok := n.until[key]
+	if ok && time.Now().After(until) {
+		delete(n.until, key)
+		return false
+	}
+	return ok
+}
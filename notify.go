@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// WebhookConfig configures the CDN change webhook. It is a no-op when URL is
+// empty.
+type WebhookConfig struct {
+	URL string `json:"url"`
+	// AuthHeader, when set, is sent as the Authorization header.
+	AuthHeader     string `json:"authHeader"`
+	TimeoutSeconds int    `json:"timeoutSeconds"`
+	MaxRetries     int    `json:"maxRetries"`
+}
+
+// notifications tracks in-flight notifications so main can wait for them
+// before exiting.
+var notifications sync.WaitGroup
+
+// notifyCDNChange sends change to the configured notifiers in the
+// background so a slow endpoint never blocks collection.
+func notifyCDNChange(change CDNChange) {
+	if config.Webhook.URL != "" {
+		notifications.Add(1)
+		go func() {
+			defer notifications.Done()
+			if err := postWebhook(config.Webhook, change); err != nil {
+				slog.Error("Error sending CDN change webhook", "account", change.AccountName, "hostname", change.Hostname, "error", err)
+			}
+		}()
+	}
+
+	if config.Slack.enabled("cdn_change") {
+		notifications.Add(1)
+		go func() {
+			defer notifications.Done()
+			notifySlackCDNChange(change)
+		}()
+	}
+}
+
+// postWebhook POSTs payload as JSON, retrying with exponential backoff on
+// network errors and 5xx/429 responses.
+func postWebhook(cfg WebhookConfig, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	timeout := time.Duration(cfg.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	retries := cfg.MaxRetries
+	if retries <= 0 {
+		retries = 3
+	}
+	client := &http.Client{Timeout: timeout}
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err = postOnce(client, cfg, body)
+		if err == nil || attempt >= retries {
+			return err
+		}
+		if re, ok := err.(*webhookStatusError); ok && !re.retryable() {
+			return err
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+type webhookStatusError struct {
+	status int
+}
+
+func (e *webhookStatusError) Error() string {
+	return fmt.Sprintf("webhook returned status %d", e.status)
+}
+
+func (e *webhookStatusError) retryable() bool {
+	return e.status == http.StatusTooManyRequests || e.status >= 500
+}
+
+func postOnce(client *http.Client, cfg WebhookConfig, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.AuthHeader != "" {
+		req.Header.Set("Authorization", cfg.AuthHeader)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return &webhookStatusError{status: resp.StatusCode}
+	}
+	return nil
+}
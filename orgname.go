@@ -0,0 +1,116 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"sync/atomic"
+	"unicode"
+)
+
+// OrgNamesConfig controls how lookup org names are turned into the pretty
+// names stored with each row.
+type OrgNamesConfig struct {
+	// Normalize matches org names that no mapping contains after
+	// lowercasing and stripping punctuation and legal suffixes, and
+	// otherwise stores them in that normalized form.
+	Normalize bool `json:"normalize"`
+	// MaxDistance, with Normalize, also maps names within this edit
+	// distance of a known pretty name. Zero disables it.
+	MaxDistance int `json:"maxDistance"`
+	// Mappings are tried before the built-in cdnOrgNameMappings.
+	Mappings []PrettyNameMapping `json:"mappings"`
+}
+
+// orgNames holds the orgNames settings in use. Like fingerprints, it is
+// swapped whole when watch mode reloads the config.
+var orgNames atomic.Pointer[OrgNamesConfig]
+
+// currentOrgNames returns the orgNames settings in use, falling back to the
+// loaded config before a Collector installs them.
+func currentOrgNames() OrgNamesConfig {
+	if p := orgNames.Load(); p != nil {
+		return *p
+	}
+	return config.OrgNames
+}
+
+// legalSuffixes are dropped from the end of org names when normalizing, so
+// "Fastly Inc" and "FASTLY, INC." compare equal.
+var legalSuffixes = []string{
+	"inc", "incorporated", "llc", "ltd", "limited", "corp", "corporation", "co", "company",
+	"gmbh", "ag", "sa", "bv", "nv", "plc", "srl", "spa", "oy", "ab", "pte", "pty", "kk",
+}
+
+// normalizeOrgName lowercases name, turns punctuation into spaces, drops
+// trailing legal suffixes and collapses whitespace.
+func normalizeOrgName(name string) string {
+	tokens := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for len(tokens) > 1 && slices.Contains(legalSuffixes, tokens[len(tokens)-1]) {
+		tokens = tokens[:len(tokens)-1]
+	}
+	return strings.Join(tokens, " ")
+}
+
+// fuzzyPrettyName matches cdnOrgName against names' mappings after
+// normalization: first by normalized pattern, then, with
+// orgNames.maxDistance set, by edit distance to each pretty name. Orgs that
+// still don't match are returned in a canonical form, the normalized name
+// in title case, so their spelling variants collapse too.
+func fuzzyPrettyName(cdnOrgName string, names OrgNamesConfig) string {
+	key := normalizeOrgName(cdnOrgName)
+	if key == "" {
+		return strings.TrimSpace(cdnOrgName)
+	}
+
+	mappings := slices.Concat(names.Mappings, cdnOrgNameMappings)
+	for _, mapping := range mappings {
+		// Normalizing drops a glob's wildcards, leaving a substring.
+		if strings.Contains(key, normalizeOrgName(mapping.Pattern)) {
+			return strings.TrimSpace(mapping.PrettyName)
+		}
+	}
+
+	if maxDistance := names.MaxDistance; maxDistance > 0 {
+		best, bestDistance := "", maxDistance+1
+		for _, mapping := range mappings {
+			if d := levenshtein(key, normalizeOrgName(mapping.PrettyName)); d < bestDistance {
+				best, bestDistance = mapping.PrettyName, d
+			}
+		}
+		if best != "" {
+			return strings.TrimSpace(best)
+		}
+	}
+
+	tokens := strings.Fields(key)
+	for i, t := range tokens {
+		r := []rune(t)
+		r[0] = unicode.ToUpper(r[0])
+		tokens[i] = string(r)
+	}
+	return strings.Join(tokens, " ")
+}
+
+// levenshtein returns the edit distance between a and b, in runes.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/url"
+	"regexp"
+
+	"github.com/chromedp/cdproto/network"
+)
+
+// Capture outcomes, stored as CdnShareData.Outcome.
+const (
+	outcomeOK         = "ok"
+	outcomeGeoBlocked = "geo_blocked"
+	outcomeNoMedia    = "no_media"
+	outcomeError      = "error"
+	// outcomeBudgetExceeded is for captures whose lookups were all skipped
+	// by lookup.maxLookups.
+	outcomeBudgetExceeded = "budget_exceeded"
+	// outcomeProviders is for the row summing up the CDN orgs a capture saw
+	// serving a hostname and stream type.
+	outcomeProviders = "providers"
+)
+
+// observedRows restricts a query on an account table to real observations,
+// leaving out the status rows of outcome.statusRows. Rows written before
+// the outcome column existed have it NULL.
+const observedRows = `(outcome = '` + outcomeOK + `' OR outcome IS NULL)`
+
+// geoBlockPattern matches the messages players typically log or throw when
+// they refuse to play in the viewer's region.
+var geoBlockPattern = regexp.MustCompile(`(?i)geo.?(block|restrict|fenc)|not available in your (country|region|location|area)|outside (of )?(the|your) (country|region)`)
+
+// recordStatus notes responses that suggest the stream is blocked: 451, or
+// 403 for the page itself or a media request.
+func (c *capture) recordStatus(ev *network.EventResponseReceived) {
+	status := ev.Response.Status
+	if status == 451 || (status == 403 && (ev.Type == network.ResourceTypeDocument || c.matchesFilters(ev.Response.URL))) {
+		c.blockedResponses.Add(1)
+	}
+}
+
+// recorded reports whether the capture's media is recorded: it wrote rows,
+// or its matches were skipped only because they were already observed this
+// run or over maxCapturesPerURL.
+func (c *capture) recorded() bool {
+	return c.rows.Load() > 0 || c.deduped.Load() > 0 || c.capped.Load() > 0
+}
+
+// outcome classifies the capture once it has finished. navErr is the error
+// from chromedp.Run, if any.
+func (c *capture) outcome(navErr error) string {
+	if c.recorded() {
+		return outcomeOK
+	}
+	if c.blockedResponses.Load() > 0 {
+		return outcomeGeoBlocked
+	}
+	for _, line := range c.consoleLines() {
+		if geoBlockPattern.MatchString(line) {
+			return outcomeGeoBlocked
+		}
+	}
+	if navErr != nil && !errors.Is(navErr, context.DeadlineExceeded) {
+		return outcomeError
+	}
+	if c.matched.Load() == 0 {
+		return outcomeNoMedia
+	}
+	if c.overBudget.Load() > 0 {
+		return outcomeBudgetExceeded
+	}
+	// Media was requested but its lookups or writes failed.
+	return outcomeError
+}
+
+// reportOutcome logs a capture that produced no rows and, with
+// outcome.statusRows set, writes a row recording why.
+func (c *capture) reportOutcome(navErr error) {
+	outcome := c.outcome(navErr)
+	if outcome == outcomeOK {
+		return
+	}
+
+	slog.Warn("Capture produced no rows", "account", c.account.Name, "url", c.url, "outcome", outcome, "blocked_responses", c.blockedResponses.Load())
+	if !config.Outcome.StatusRows {
+		return
+	}
+
+	var hostname string
+	if u, err := url.Parse(c.url); err == nil {
+		hostname = u.Host
+	}
+	data := CdnShareData{
+		Timestamp:          observationTime(),
+		CustomerHostname:   hostname,
+		CustomerStreamType: c.streamType,
+		AccountName:        c.account.Name,
+		AccountUnit:        c.account.Unit,
+		AccountID:          c.account.ID,
+		Outcome:            outcome,
+		EmulationProfile:   c.account.emulation().profileName(),
+		table:              c.account.DBTableName,
+	}
+	if err := sink.Write(data); err != nil {
+		stats.error()
+		slog.Error("Error saving status row", "account", c.account.Name, "url", c.url, "outcome", outcome, "error", err)
+	}
+}
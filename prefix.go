@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// whoisPrefixFields are the WHOIS fields that hold the network CIDR(s) an IP
+// belongs to: ARIN's "CIDR" and the RIRs' route objects.
+var whoisPrefixFields = []string{"CIDR:", "route:", "route6:", "inet6num:"}
+
+// whoisPrefix returns the most specific CIDR in whoisResult that contains
+// ip, or "" if there is none.
+func whoisPrefix(whoisResult string, ip net.IP) string {
+	best, bestBits := "", -1
+	for _, line := range strings.Split(whoisResult, "\n") {
+		for _, field := range whoisPrefixFields {
+			if !strings.HasPrefix(line, field) {
+				continue
+			}
+			// ARIN lists several ranges on one line: "104.16.0.0/13, 104.24.0.0/14".
+			for _, cidr := range strings.Split(line[len(field):], ",") {
+				_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+				if err != nil || !network.Contains(ip) {
+					continue
+				}
+				if bits, _ := network.Mask.Size(); bits > bestBits {
+					best, bestBits = network.String(), bits
+				}
+			}
+		}
+	}
+	return best
+}
+
+// cachePut caches a lookup result for ip and, with cache.byPrefix set, for
+// the whole prefix it belongs to.
+func cachePut(ip net.IP, data WhoisCacheData) {
+	whoisCache.Put(ip.String(), data)
+	if config.Cache.ByPrefix && data.Prefix != "" {
+		whoisCache.Put(data.Prefix, data)
+	}
+}
+
+// cacheGet returns the cached lookup result for ip, falling back to the most
+// specific cached prefix containing it when cache.byPrefix is set.
+func cacheGet(ip net.IP) (WhoisCacheData, bool) {
+	if data, ok := whoisCache.Get(ip.String()); ok || !config.Cache.ByPrefix {
+		return data, ok
+	}
+
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	for ones := bits; ones >= 8; ones-- {
+		network := net.IPNet{IP: ip.Mask(net.CIDRMask(ones, bits)), Mask: net.CIDRMask(ones, bits)}
+		if data, ok := whoisCache.Get(network.String()); ok {
+			return data, true
+		}
+	}
+	return WhoisCacheData{}, false
+}
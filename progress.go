@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// showProgress is set by the -progress flag.
+var showProgress bool
+
+const (
+	progressTTYInterval = time.Second
+	progressLogInterval = 30 * time.Second
+)
+
+// progress reports how far a run has got: a redrawn status line when
+// stderr is a terminal, or a periodic log line otherwise.
+type progress struct {
+	accounts int
+	urls     int
+	done     atomic.Int64
+	tty      bool
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// startProgress starts reporting on a run over accounts. Call accountDone as
+// each account finishes and finish when the run is over.
+func startProgress(accounts []Account) *progress {
+	p := &progress{accounts: len(accounts), tty: isTerminal(os.Stderr), stop: make(chan struct{})}
+	for _, a := range accounts {
+		for _, u := range a.streamURLs() {
+			if wantStreamType(u.StreamType) {
+				p.urls++
+			}
+		}
+	}
+
+	interval := progressLogInterval
+	if p.tty {
+		interval = progressTTYInterval
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.report()
+			case <-p.stop:
+				if p.tty {
+					// Leave the final state on screen above the summary.
+					p.report()
+					fmt.Fprintln(os.Stderr)
+				}
+				return
+			}
+		}
+	}()
+	return p
+}
+
+func (p *progress) accountDone() {
+	p.done.Add(1)
+}
+
+func (p *progress) finish() {
+	close(p.stop)
+	p.wg.Wait()
+}
+
+func (p *progress) report() {
+	r := stats.snapshot()
+	var hitRate float64
+	if lookups := r.CacheHits + r.CacheMisses; lookups > 0 {
+		hitRate = float64(r.CacheHits) / float64(lookups) * 100
+	}
+	elapsed := time.Duration(r.DurationSeconds * float64(time.Second)).Round(time.Second)
+
+	if p.tty {
+		// \r and erase-line redraw the status in place.
+		fmt.Fprintf(os.Stderr, "\r\033[KAccounts %d/%d  URLs %d/%d  Rows %d  Cache hit rate %.0f%%  Errors %d  %s",
+			p.done.Load(), p.accounts, r.URLsVisited, p.urls, r.RowsWritten, hitRate, r.Errors, elapsed)
+		return
+	}
+	slog.Info("Progress", "accounts_done", p.done.Load(), "accounts", p.accounts, "urls_visited", r.URLsVisited, "urls", p.urls,
+		"rows", r.RowsWritten, "cache_hit_rate", fmt.Sprintf("%.0f%%", hitRate), "errors", r.Errors, "elapsed", elapsed)
+}
+
+// isTerminal reports whether w is a character device, such as a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
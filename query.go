@@ -0,0 +1,206 @@
+package main
+
+import (
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// queryFilter narrows the observations read back by the query subcommand.
+// Empty fields match everything.
+type queryFilter struct {
+	Hostname   string
+	StreamType string
+	Since      time.Time
+	Limit      int
+	// Latest keeps only the most recent observation per account, hostname
+	// and stream type.
+	Latest bool
+}
+
+// runQuery implements the query subcommand: it reads observations back from
+// each account's table and prints them newest first.
+func runQuery(args []string) int {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	accounts := fs.String("accounts", "", "comma-separated account names to query (default all)")
+	hostname := fs.String("hostname", "", "only show this hostname")
+	streamType := fs.String("stream-type", "", "only show this stream type")
+	since := fs.String("since", "", "only show observations after this time: a duration such as 24h, or a date (2006-01-02 or RFC 3339)")
+	format := fs.String("format", "table", "output format: table, csv or json")
+	limit := fs.Int("limit", 100, "maximum rows per account, 0 for no limit")
+	latest := fs.Bool("latest", false, "show only the current CDN per account, hostname and stream type")
+	fs.Parse(args)
+
+	err := setup()
+	if err != nil {
+		slog.Error("Error loading config", "error", err)
+		return exitConfigError
+	}
+
+	filter := queryFilter{Hostname: *hostname, StreamType: *streamType, Limit: *limit, Latest: *latest}
+	filter.Since, err = parseSince(*since, time.Now())
+	if err != nil {
+		slog.Error("Invalid -since", "error", err)
+		return exitConfigError
+	}
+	if !slices.Contains([]string{"table", "csv", "json"}, *format) {
+		slog.Error("Invalid -format, expected table, csv or json", "format", *format)
+		return exitConfigError
+	}
+
+	err = openDB()
+	if err != nil {
+		fatal("Error opening database", "error", err)
+	}
+	defer db.Close()
+
+	var rows []CdnShareData
+	for _, a := range filterAccounts(config.Accounts, splitList(*accounts), nil) {
+		if a.DBTableName == "" {
+			continue
+		}
+		r, err := queryObservations(a.DBTableName, a.Name, filter)
+		if err != nil {
+			fatal("Error querying observations", "account", a.Name, "table", a.DBTableName, "error", err)
+		}
+		rows = append(rows, r...)
+	}
+
+	slices.SortStableFunc(rows, func(a, b CdnShareData) int {
+		return b.Timestamp.Compare(a.Timestamp)
+	})
+
+	switch *format {
+	case "json":
+		err = printObservationsJSON(os.Stdout, rows)
+	case "csv":
+		err = printObservationsCSV(os.Stdout, rows)
+	default:
+		err = printObservationsTable(os.Stdout, rows)
+	}
+	if err != nil {
+		fatal("Error printing observations", "error", err)
+	}
+	return exitOK
+}
+
+// parseSince parses a -since value relative to now. An empty value means no
+// lower bound.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339, time.DateTime, time.DateOnly} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is neither a duration nor a date", s)
+}
+
+// queryObservations selects account's rows matching filter from tableName,
+// newest first. Accounts may share a table, so rows are always restricted to
+// the account's own.
+func queryObservations(tableName, account string, filter queryFilter) ([]CdnShareData, error) {
+	// Providers rows sum up a capture rather than observe a CDN.
+	where := []string{"account_name = ?", "(outcome <> '" + outcomeProviders + "' OR outcome IS NULL)"}
+	args := []any{account}
+	if filter.Hostname != "" {
+		where, args = append(where, "hostname = ?"), append(args, filter.Hostname)
+	}
+	if filter.StreamType != "" {
+		where, args = append(where, "stream_type = ?"), append(args, filter.StreamType)
+	}
+	if !filter.Since.IsZero() {
+		where, args = append(where, "timestamp >= ?"), append(args, filter.Since)
+	}
+
+	conds := " WHERE " + strings.Join(where, " AND ")
+
+	query := fmt.Sprintf(`SELECT timestamp, cdn_ip, hostname, cdn_orgname, stream_type, account_name, account_unit, account_id FROM %s`, tableName) + conds
+	if filter.Latest {
+		// A grouped self-join rather than a window function, so it also
+		// works on MySQL 5.7. Status rows are left out on both sides, so
+		// the latest row is always a real observation with its CDN org.
+		query = fmt.Sprintf(`SELECT t.timestamp, t.cdn_ip, t.hostname, t.cdn_orgname, t.stream_type, t.account_name, t.account_unit, t.account_id
+			FROM %[1]s t
+			JOIN (SELECT account_id, hostname, stream_type, MAX(timestamp) AS latest FROM %[1]s%[2]s AND %[3]s GROUP BY account_id, hostname, stream_type) m
+			ON t.account_id = m.account_id AND t.hostname = m.hostname AND t.stream_type = m.stream_type AND t.timestamp = m.latest
+			WHERE (t.outcome = '%[4]s' OR t.outcome IS NULL)`, tableName, conds, observedRows, outcomeOK)
+	}
+	query += " ORDER BY timestamp DESC"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []CdnShareData
+	for rows.Next() {
+		var d CdnShareData
+		err := rows.Scan(&d.Timestamp, &d.CdnIp, &d.CustomerHostname, &d.CdnOrgName, &d.CustomerStreamType, &d.AccountName, &d.AccountUnit, &d.AccountID)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if filter.Latest {
+		// Rows sharing the latest timestamp would otherwise all be kept.
+		seen := make(map[[3]string]bool)
+		out = slices.DeleteFunc(out, func(d CdnShareData) bool {
+			key := [3]string{d.AccountID, d.CustomerHostname, d.CustomerStreamType}
+			dup := seen[key]
+			seen[key] = true
+			return dup
+		})
+	}
+	return out, nil
+}
+
+func printObservationsTable(w io.Writer, rows []CdnShareData) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIMESTAMP\tACCOUNT\tHOSTNAME\tSTREAM TYPE\tCDN ORG\tCDN IP")
+	for _, r := range rows {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Timestamp.Format(time.DateTime), r.AccountName, r.CustomerHostname, r.CustomerStreamType, cmp.Or(r.CdnOrgName, "-"), r.CdnIp)
+	}
+	return tw.Flush()
+}
+
+func printObservationsCSV(w io.Writer, rows []CdnShareData) error {
+	cw := csv.NewWriter(w)
+	cw.Write(csvHeader)
+	for _, r := range rows {
+		cw.Write(csvRecord(r))
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func printObservationsJSON(w io.Writer, rows []CdnShareData) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if rows == nil {
+		rows = []CdnShareData{}
+	}
+	return enc.Encode(rows)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// rateLimiter spaces out calls so that at most one is let through per
+// interval. A zero interval disables limiting.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	if perSecond <= 0 {
+		return &rateLimiter{}
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// Wait blocks until the caller is allowed to proceed, or returns ctx's
+// error if it ends first.
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	if l == nil || l.interval == 0 {
+		return ctx.Err()
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(jitter(l.interval))
+	l.mu.Unlock()
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// jitter randomly spreads d by up to config.JitterPercent in either
+// direction, so that accounts started together drift apart.
+func jitter(d time.Duration) time.Duration {
+	pct := config.JitterPercent
+	if pct <= 0 || d <= 0 {
+		return d
+	}
+
+	spread := float64(d) * pct / 100
+	return d + time.Duration((rand.Float64()*2-1)*spread)
+}
+
+// jitterUp randomly lengthens d by up to config.JitterPercent.
+func jitterUp(d time.Duration) time.Duration {
+	pct := config.JitterPercent
+	if pct <= 0 || d <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Float64()*float64(d)*pct/100)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+)
+
+const rawWhoisTable = "whois_raw"
+
+const rawWhoisTableSchema = `CREATE TABLE %s (
+	"cdn_ip" varchar(64) CHARACTER SET utf8 COLLATE utf8_general_ci NOT NULL,
+	"prefix" ` + prefixColumn + `,
+	"whois" longtext CHARACTER SET utf8 COLLATE utf8_general_ci,
+	"created_at" ` + createdAtColumn + `,
+	UNIQUE KEY "PRIMARY" ("cdn_ip") USING HASH,
+	SHARD KEY "__SHARDKEY" ("cdn_ip"),
+	KEY "__UNORDERED" () USING CLUSTERED COLUMNSTORE
+) AUTOSTATS_CARDINALITY_MODE=INCREMENTAL AUTOSTATS_HISTOGRAM_MODE=CREATE AUTOSTATS_SAMPLING=ON SQL_MODE='STRICT_ALL_TABLES'`
+
+// rawWhoisSaved records the IPs whose raw WHOIS this process has already
+// written, so each is sent to the database once.
+var rawWhoisSaved sync.Map
+
+// saveRawWhois stores the raw WHOIS (or RDAP, ipinfo or Team Cymru) answer
+// for data's IP in whois_raw, which observation rows reference by cdn_ip.
+// The first answer stored for an IP is kept.
+func saveRawWhois(db *sql.DB, data CdnShareData) error {
+	if data.ParsedWhois == "" {
+		return nil
+	}
+	if _, ok := rawWhoisSaved.Load(data.CdnIp); ok {
+		return nil
+	}
+
+	err := ensureTableExists(db, rawWhoisTable, rawWhoisTableSchema)
+	if err != nil {
+		return fmt.Errorf("error ensuring table exists: %w", err)
+	}
+
+	query := fmt.Sprintf(`INSERT IGNORE INTO %s (cdn_ip, prefix, whois) VALUES (?, ?, ?)`, rawWhoisTable)
+	_, err = db.Exec(query, data.CdnIp, data.Prefix, data.ParsedWhois)
+	if err != nil {
+		return err
+	}
+	rawWhoisSaved.Store(data.CdnIp, true)
+	return nil
+}
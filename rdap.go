@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// rdapBootstrapURL redirects each query to the RIR responsible for the IP.
+const rdapBootstrapURL = "https://rdap.org/ip/"
+
+var rdapClient = &http.Client{Timeout: 10 * time.Second}
+
+// rdapNetwork is the subset of an RDAP IP network response that we use.
+type rdapNetwork struct {
+	Handle   string       `json:"handle"`
+	Name     string       `json:"name"`
+	Entities []rdapEntity `json:"entities"`
+	CIDRs    []struct {
+		V4Prefix string `json:"v4prefix"`
+		V6Prefix string `json:"v6prefix"`
+		Length   int    `json:"length"`
+	} `json:"cidr0_cidrs"`
+}
+
+type rdapEntity struct {
+	Roles      []string     `json:"roles"`
+	VCardArray []any        `json:"vcardArray"`
+	Entities   []rdapEntity `json:"entities"`
+}
+
+// lookupRDAP looks up the CDN org for ip with RDAP, the structured
+// successor to WHOIS.
+func lookupRDAP(ctx context.Context, hostname string, ip net.IP) (CdnShareData, error) {
+	if err := lookupLimiter.Wait(ctx); err != nil {
+		return CdnShareData{}, err
+	}
+
+	lookupsTotal.WithLabelValues("rdap").Inc()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rdapBootstrapURL+ip.String(), nil)
+	if err != nil {
+		return CdnShareData{}, err
+	}
+	resp, err := rdapClient.Do(req)
+	if err != nil {
+		return CdnShareData{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return CdnShareData{}, fmt.Errorf("rdap returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return CdnShareData{}, err
+	}
+
+	var network rdapNetwork
+	if err := json.Unmarshal(body, &network); err != nil {
+		return CdnShareData{}, fmt.Errorf("error decoding rdap response: %w", err)
+	}
+
+	org := rdapRegistrant(network.Entities)
+	if org == "" {
+		org = network.Name
+	}
+	prettyName := prettyCdnOrgName(org)
+
+	var prefix string
+	if len(network.CIDRs) > 0 {
+		c := network.CIDRs[0]
+		prefix = c.V4Prefix + c.V6Prefix + "/" + strconv.Itoa(c.Length)
+	}
+
+	cachePut(ip, WhoisCacheData{
+		Timestamp:   time.Now(),
+		CdnOrgName:  prettyName,
+		ParsedWhois: string(body),
+		Prefix:      prefix,
+		Provider:    "rdap",
+	})
+	slog.Debug("Looked up CDN org", "provider", "rdap", "hostname", hostname, "ip", ip.String(), "cdn_org", prettyName)
+	return CdnShareData{
+		Timestamp:        observationTime(),
+		CdnIp:            ip.String(),
+		CustomerHostname: hostname,
+		CdnOrgName:       prettyName,
+		ParsedWhois:      string(body),
+		Prefix:           prefix,
+	}, nil
+}
+
+// rdapRegistrant returns the vCard name of the registrant entity, searching
+// nested entities too.
+func rdapRegistrant(entities []rdapEntity) string {
+	for _, e := range entities {
+		if slices.Contains(e.Roles, "registrant") {
+			if fn := vcardFN(e.VCardArray); fn != "" {
+				return fn
+			}
+		}
+		if fn := rdapRegistrant(e.Entities); fn != "" {
+			return fn
+		}
+	}
+	return ""
+}
+
+// vcardFN returns the "fn" property of a jCard: ["vcard", [[name, params,
+// type, value], ...]].
+func vcardFN(vcard []any) string {
+	if len(vcard) < 2 {
+		return ""
+	}
+	props, _ := vcard[1].([]any)
+	for _, p := range props {
+		prop, _ := p.([]any)
+		if len(prop) >= 4 && prop[0] == "fn" {
+			fn, _ := prop[3].(string)
+			return fn
+		}
+	}
+	return ""
+}
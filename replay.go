@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/network"
+)
+
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	account := fs.String("account", "", "attribute rows to this account instead of the one whose URLs include the HAR's page")
+	streamType := fs.String("stream-type", "", "use this stream type instead of the page URL's configured one")
+	summaryJSON := fs.String("summary-json", "", "write the run summary as JSON to this path")
+	distribution := fs.String("distribution", "", "write each account's share of hostnames per CDN org to this path, as CSV if it ends in .csv and JSON otherwise")
+	fs.BoolVar(&dryRun, "dry-run", false, "look up as usual, but only write rows to stdout outputs and do not save the cache")
+	fs.StringVar(&cacheFlag, "cache", "", "use this cache file, overriding cache.file and cache.namespace")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: cdnshare replay [flags] <file.har or directory>...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitConfigError
+	}
+
+	err := setup()
+	if err != nil {
+		slog.Error("Error loading config", "error", err)
+		return exitConfigError
+	}
+
+	err = loadURLsFiles(config.Accounts)
+	if err != nil {
+		slog.Error("Error loading URLs file", "error", err)
+		return exitConfigError
+	}
+
+	files, err := harFiles(fs.Args())
+	if err != nil {
+		slog.Error("Error finding HAR files", "error", err)
+		return exitConfigError
+	}
+
+	sink, err = openSinks(config.Outputs)
+	if err != nil {
+		fatal("Error opening outputs", "error", err)
+	}
+
+	collector, err := NewCollector(config, sink)
+	if err != nil {
+		fatal("Error starting collector", "error", err)
+	}
+	defer func() {
+		if err := collector.Close(); err != nil {
+			fatal("Error closing outputs", "error", err)
+		}
+	}()
+
+	summary, err := collector.Replay(files, *account, *streamType)
+	if err != nil {
+		fatal("Error saving state", "error", err)
+	}
+
+	printSummary(os.Stderr, summary)
+	if *summaryJSON != "" {
+		if err := writeSummaryJSON(*summaryJSON, summary); err != nil {
+			fatal("Error writing summary", "error", err, "path", *summaryJSON)
+		}
+	}
+	if *distribution != "" {
+		if err := writeDistribution(*distribution, summary); err != nil {
+			fatal("Error writing CDN distribution", "error", err, "path", *distribution)
+		}
+	}
+	return exitStatus(summary)
+}
+
+// harFiles expands directories in paths to the .har files they contain.
+func harFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(p, "*.har"))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// Replay feeds the page loads recorded in HAR files, such as those written
+// with -har-dir, through the same request and response handling as a live
+// capture, so rows are re-derived with the current mappings and rules and
+// written to the sink. Hosts are attributed to the server IP the HAR
+// recorded rather than resolved again, and rows carry the time of the
+// original request.
+//
+// Each HAR is attributed to accountName, or else to the first account whose
+// URLs include the HAR's page. HARs hold no response bodies, so stream types
+// are never detected from manifests.
+func (c *Collector) Replay(files []string, accountName, streamType string) (RunSummary, error) {
+	stats.reset()
+	observed = newDedupSet(config.Dedup.Scope)
+	lookups = newLookupBudget(config.Lookup.MaxLookups)
+
+	for _, f := range files {
+		if err := replayHAR(f, accountName, streamType); err != nil {
+			stats.error()
+			slog.Error("Error replaying HAR", "path", f, "error", err)
+		}
+	}
+	notifications.Wait()
+
+	if !dryRun {
+		if err := saveCache(); err != nil {
+			return RunSummary{}, fmt.Errorf("error saving cache %s: %w", cacheFile, err)
+		}
+	}
+
+	summary := stats.snapshot()
+	summary.IPInfoTokenUsage = ipinfoTokens.Usage()
+	summary.LookupCost = float64(summary.Lookups) * config.Lookup.CostPerLookup
+	return summary, nil
+}
+
+func replayHAR(path, accountName, streamType string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var f struct {
+		Log harLog `json:"log"`
+	}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return err
+	}
+	if len(f.Log.Pages) == 0 {
+		return errors.New("no pages")
+	}
+	pageURL := f.Log.Pages[0].Title
+
+	account, configured, ok := replayAccount(pageURL, accountName)
+	if !ok {
+		return fmt.Errorf("no account collects %s, use -account", pageURL)
+	}
+	if streamType == "" {
+		streamType = configured
+	}
+	if streamType == "" {
+		return fmt.Errorf("%s is not one of account %s's URLs, use -stream-type", pageURL, account.Name)
+	}
+
+	stats.urlVisited()
+	c := &capture{account: account, url: pageURL, streamType: streamType, ctx: context.Background(), replayIPs: make(map[string]net.IP)}
+	for _, e := range f.Log.Entries {
+		ip := net.ParseIP(strings.Trim(e.ServerIPAddress, "[]"))
+		if host := hostOf(e.Request.URL); ip != nil && host != "" {
+			c.replayIPs[host] = ip
+		}
+	}
+
+	for i, e := range f.Log.Entries {
+		c.replayTime = e.StartedDateTime
+		id := network.RequestID(strconv.Itoa(i))
+		ts := cdp.MonotonicTime(e.StartedDateTime)
+		resourceType := network.ResourceType(e.ResourceType)
+		if resourceType == "" && e.Request.URL == pageURL {
+			resourceType = network.ResourceTypeDocument
+		} else if resourceType == "" {
+			resourceType = network.ResourceTypeOther
+		}
+
+		processRequest(&network.EventRequestWillBeSent{
+			RequestID: id,
+			Request:   &network.Request{URL: e.Request.URL, Method: e.Request.Method},
+			Timestamp: &ts,
+			Type:      resourceType,
+		}, c)
+
+		if e.Response.Status == 0 {
+			continue
+		}
+		headers := make(network.Headers, len(e.Response.Headers))
+		for _, h := range e.Response.Headers {
+			headers[h.Name] = h.Value
+		}
+		processResponse(&network.EventResponseReceived{
+			RequestID: id,
+			Type:      resourceType,
+			Response: &network.Response{
+				URL:      e.Request.URL,
+				Status:   e.Response.Status,
+				MimeType: e.Response.Content.MimeType,
+				Headers:  headers,
+			},
+		}, c)
+	}
+
+	if c.matched.Load() == 0 {
+		stats.urlWithoutMatches()
+		slog.Warn("No requests matched the media filters", "account", account.Name, "url", pageURL, "requests_seen", c.requests.Load(), "filters", account.MediaTypeFilters)
+	}
+	c.reportMultiCDN()
+	c.reportOutcome(nil)
+	return nil
+}
+
+// replayAccount returns the account to attribute a replayed page to and
+// the stream type configured for the page, if any.
+func replayAccount(pageURL, accountName string) (Account, string, bool) {
+	for _, a := range config.Accounts {
+		if accountName != "" && a.Name != accountName {
+			continue
+		}
+		for _, u := range a.streamURLs() {
+			if u.URL == pageURL {
+				return a, u.StreamType, true
+			}
+		}
+		if accountName != "" {
+			return a, "", true
+		}
+	}
+	return Account{}, "", false
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultResumeStateFile = "resume_state.json"
+
+// resumeState records, per account, when it last finished all its URLs and
+// which URLs of an unfinished pass are already done, so a run restarted
+// after a crash or timeout picks up where the last one stopped. Unlike
+// incremental mode, a URL counts as done once it was visited, whether or
+// not it produced observations.
+//
+// The file is rewritten after every URL, so it is current even if the
+// process dies.
+type resumeState struct {
+	mu       sync.Mutex
+	path     string
+	maxAge   time.Duration
+	accounts map[string]*resumeAccount
+}
+
+type resumeAccount struct {
+	// Completed is when the account last finished all of its URLs.
+	Completed time.Time `json:"completed"`
+	// URLs holds when each URL of the current pass was visited, keyed by
+	// "streamType|url".
+	URLs map[string]time.Time `json:"urls,omitempty"`
+}
+
+// loadResumeState reads the state file at path. A zero maxAge disables
+// resuming and no file is read or written.
+func loadResumeState(path string, maxAge time.Duration) (*resumeState, error) {
+	if path == "" {
+		path = defaultResumeStateFile
+	}
+	s := &resumeState{path: path, maxAge: maxAge, accounts: make(map[string]*resumeAccount)}
+	if maxAge <= 0 {
+		return s, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, json.Unmarshal(b, &s.accounts)
+}
+
+func resumeURLKey(u StreamURL) string {
+	return u.StreamType + "|" + u.URL
+}
+
+// accountFresh reports whether account finished all its URLs within the
+// freshness window.
+func (s *resumeState) accountFresh(account string) bool {
+	if s.maxAge <= 0 {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.accounts[account]
+	return ok && time.Since(a.Completed) < s.maxAge
+}
+
+// urlFresh reports whether u was visited within the freshness window in the
+// account's current pass.
+func (s *resumeState) urlFresh(account string, u StreamURL) bool {
+	if s.maxAge <= 0 {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.accounts[account]
+	if !ok {
+		return false
+	}
+	last, ok := a.URLs[resumeURLKey(u)]
+	return ok && time.Since(last) < s.maxAge
+}
+
+// urlDone records that u was visited and saves the state.
+func (s *resumeState) urlDone(account string, u StreamURL) error {
+	if s.maxAge <= 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.account(account)
+	if a.URLs == nil {
+		a.URLs = make(map[string]time.Time)
+	}
+	a.URLs[resumeURLKey(u)] = time.Now()
+	return s.save()
+}
+
+// accountDone records that account finished all its URLs, starting a new
+// pass, and saves the state.
+func (s *resumeState) accountDone(account string) error {
+	if s.maxAge <= 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.account(account)
+	a.Completed = time.Now()
+	a.URLs = nil
+	return s.save()
+}
+
+func (s *resumeState) account(name string) *resumeAccount {
+	a, ok := s.accounts[name]
+	if !ok {
+		a = &resumeAccount{}
+		s.accounts[name] = a
+	}
+	return a
+}
+
+// save writes the state to a temporary file and renames it into place, so
+// a crash mid-write leaves the previous state intact. s.mu must be held.
+func (s *resumeState) save() error {
+	b, err := json.MarshalIndent(s.accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
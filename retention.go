@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const defaultRetentionBatchSize = 10000
+
+// purgeOldRows deletes observations older than maxAge from each account's
+// table, batchSize rows at a time so no single DELETE holds locks for long.
+func purgeOldRows(accounts []Account, maxAge time.Duration, batchSize int) error {
+	cutoff := time.Now().Add(-maxAge)
+
+	for _, a := range accounts {
+		if a.DBTableName == "" {
+			continue
+		}
+
+		var purged int64
+		for {
+			res, err := db.Exec(fmt.Sprintf(`DELETE FROM %s WHERE timestamp < ? LIMIT %d`, a.DBTableName, batchSize), cutoff)
+			if err != nil {
+				return fmt.Errorf("error purging %s: %w", a.DBTableName, err)
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return fmt.Errorf("error purging %s: %w", a.DBTableName, err)
+			}
+			purged += n
+			if n < int64(batchSize) {
+				break
+			}
+		}
+
+		slog.Info("Purged old rows", "account", a.Name, "table", a.DBTableName, "rows", purged, "cutoff", cutoff)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+//go:build integration
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// openTestDB connects the package db to the database named by
+// CDNSHARE_TEST_DSN, skipping the test when it is unset.
+func openTestDB(t *testing.T) {
+	t.Helper()
+
+	dsn := os.Getenv("CDNSHARE_TEST_DSN")
+	if dsn == "" {
+		t.Skip("CDNSHARE_TEST_DSN not set")
+	}
+	conn, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	prev := db
+	db = conn
+	t.Cleanup(func() {
+		db = prev
+		conn.Close()
+	})
+}
+
+func TestPurgeOldRows(t *testing.T) {
+	openTestDB(t)
+
+	table := fmt.Sprintf("cdnshare_retention_test_%d", time.Now().UnixNano())
+	if _, err := db.Exec(fmt.Sprintf(`CREATE TABLE %s (id int NOT NULL, timestamp datetime NOT NULL, PRIMARY KEY (id))`, table)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec("DROP TABLE " + table) })
+
+	now := time.Now()
+	ages := []time.Duration{
+		1 * time.Hour,
+		12 * time.Hour,
+		47 * time.Hour,
+		49 * time.Hour,
+		72 * time.Hour,
+		30 * 24 * time.Hour,
+		90 * 24 * time.Hour,
+	}
+	for i, age := range ages {
+		if _, err := db.Exec(fmt.Sprintf(`INSERT INTO %s (id, timestamp) VALUES (?, ?)`, table), i, now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A batch size smaller than the number of stale rows exercises the
+	// batching loop.
+	accounts := []Account{{Name: "test", DBTableName: table}}
+	if err := purgeOldRows(accounts, 48*time.Hour, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.Query(fmt.Sprintf(`SELECT id FROM %s ORDER BY id`, table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var kept []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		kept = append(kept, id)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []int{0, 1, 2}
+	if fmt.Sprint(kept) != fmt.Sprint(want) {
+		t.Errorf("kept rows %v, want %v", kept, want)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// RetryConfig controls retries with exponential backoff. The delay before
+// retry n is BaseDelayMs * 2^(n-1), capped at MaxDelayMs.
+type RetryConfig struct {
+	// Attempts is the total number of tries, including the first.
+	Attempts    int `json:"attempts"`
+	BaseDelayMs int `json:"baseDelayMs"`
+	MaxDelayMs  int `json:"maxDelayMs"`
+}
+
+// retry calls op until it succeeds, returns an error retryable rejects, or
+// cfg.Attempts tries have been made. It stops waiting early if ctx ends.
+func retry(ctx context.Context, cfg RetryConfig, retryable func(error) bool, op func() error) error {
+	delay := time.Duration(cfg.BaseDelayMs) * time.Millisecond
+	maxDelay := time.Duration(cfg.MaxDelayMs) * time.Millisecond
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = op()
+		if err == nil || attempt >= cfg.Attempts || !retryable(err) {
+			return err
+		}
+
+		wait := jitter(min(delay, maxDelay))
+		slog.Debug("Retrying after error", "attempt", attempt, "delay", wait, "error", err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		}
+		delay *= 2
+	}
+}
+
+// whoisRetryable reports whether a WHOIS error is worth retrying: network
+// timeouts, dropped or refused connections, and rate limiting. Anything
+// else, such as a malformed query, fails the same way every time.
+func whoisRetryable(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNABORTED) {
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{"rate limit", "too many", "limit exceeded", "try again", "temporarily"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
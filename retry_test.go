@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+)
+
+// flakyWhois returns a WHOIS stub that fails with errs in turn, then
+// succeeds, counting its calls.
+func flakyWhois(calls *int, errs ...error) func() error {
+	return func() error {
+		*calls++
+		if *calls <= len(errs) {
+			return errs[*calls-1]
+		}
+		return nil
+	}
+}
+
+var testRetry = RetryConfig{Attempts: 4, BaseDelayMs: 1, MaxDelayMs: 2}
+
+func TestRetryRetryableErrors(t *testing.T) {
+	var calls int
+	op := flakyWhois(&calls, syscall.ECONNRESET, errors.New("rate limit exceeded"))
+
+	if err := retry(context.Background(), testRetry, whoisRetryable, op); err != nil {
+		t.Fatalf("retry() = %v, want success", err)
+	}
+	if calls != 3 {
+		t.Errorf("op called %d times, want 3", calls)
+	}
+}
+
+func TestRetryGivesUpAfterAttempts(t *testing.T) {
+	var calls int
+	op := flakyWhois(&calls, syscall.ECONNREFUSED, syscall.ECONNREFUSED, syscall.ECONNREFUSED, syscall.ECONNREFUSED, syscall.ECONNREFUSED)
+
+	err := retry(context.Background(), testRetry, whoisRetryable, op)
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("retry() = %v, want ECONNREFUSED", err)
+	}
+	if calls != testRetry.Attempts {
+		t.Errorf("op called %d times, want %d", calls, testRetry.Attempts)
+	}
+}
+
+func TestRetryPermanentError(t *testing.T) {
+	permanent := fmt.Errorf("malformed query")
+	var calls int
+	op := flakyWhois(&calls, permanent)
+
+	if err := retry(context.Background(), testRetry, whoisRetryable, op); !errors.Is(err, permanent) {
+		t.Fatalf("retry() = %v, want %v", err, permanent)
+	}
+	if calls != 1 {
+		t.Errorf("op called %d times, want 1", calls)
+	}
+}
+
+func TestRetryCanceledBetweenAttempts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls int
+	op := func() error {
+		calls++
+		// Cancel during the first attempt, so retry must notice while
+		// waiting to try again.
+		cancel()
+		return syscall.ECONNRESET
+	}
+
+	// A long delay makes the test hang rather than pass if cancellation is
+	// ignored.
+	cfg := RetryConfig{Attempts: 3, BaseDelayMs: 60_000, MaxDelayMs: 60_000}
+	err := retry(ctx, cfg, whoisRetryable, op)
+	if !errors.Is(err, context.Canceled) || !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("retry() = %v, want both ECONNRESET and context.Canceled", err)
+	}
+	if calls != 1 {
+		t.Errorf("op called %d times, want 1", calls)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// rirWhoisServers are the WHOIS servers of the regional internet
+// registries, by the registry names Team Cymru reports.
+var rirWhoisServers = map[string]string{
+	"arin":    "whois.arin.net",
+	"ripencc": "whois.ripe.net",
+	"apnic":   "whois.apnic.net",
+	"lacnic":  "whois.lacnic.net",
+	"afrinic": "whois.afrinic.net",
+}
+
+// rirDefault is the lookup.whoisRirRequestsPerSecond key for registries
+// without their own limit, and for IPs whose registry is unknown.
+const rirDefault = "default"
+
+// rirLimiters holds one rate limiter per registry, created on first use.
+var rirLimiters sync.Map
+
+// whoisRIR returns the registry responsible for ip, from Team Cymru's
+// origin data, or "" if it can't be found before ctx ends or within 5s.
+func whoisRIR(ctx context.Context, ip net.IP) string {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	origin, err := cymruLookupOrigin(ctx, ip)
+	if err != nil {
+		return ""
+	}
+	return origin.Registry
+}
+
+// rirLimiter returns the rate limiter for rir, configured from
+// lookup.whoisRirRequestsPerSecond.
+func rirLimiter(rir string) *rateLimiter {
+	limits := config.Lookup.WhoisRIRRequestsPerSecond
+	if _, ok := limits[rir]; !ok {
+		rir = rirDefault
+	}
+	l, _ := rirLimiters.LoadOrStore(rir, newRateLimiter(limits[rir]))
+	return l.(*rateLimiter)
+}
+
+// WhoisServerOverride forces the WHOIS server used for IPs in CIDR, or for
+// hostnames ending in HostnameSuffix. An entry setting both needs both to
+// match.
+type WhoisServerOverride struct {
+	CIDR           string `json:"cidr"`
+	HostnameSuffix string `json:"hostnameSuffix"`
+	Server         string `json:"server"`
+}
+
+func (o WhoisServerOverride) matches(hostname string, ip net.IP) bool {
+	if o.CIDR != "" {
+		_, network, err := net.ParseCIDR(o.CIDR)
+		if err != nil || !network.Contains(ip) {
+			return false
+		}
+	}
+	if o.HostnameSuffix != "" && !hasDNSSuffix(hostname, o.HostnameSuffix) {
+		return false
+	}
+	return true
+}
+
+// whoisServerOverride returns the server of the first entry in
+// lookup.whoisServers matching hostname and ip, or "".
+func whoisServerOverride(hostname string, ip net.IP) string {
+	for _, o := range config.Lookup.WhoisServers {
+		if o.matches(hostname, ip) {
+			return o.Server
+		}
+	}
+	return ""
+}
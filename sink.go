@@ -0,0 +1,469 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sink receives collected rows. Implementations must be safe for concurrent
+// use, since accounts are collected in parallel.
+type Sink interface {
+	Write(data CdnShareData) error
+	// Flush is called at the end of every run. Sinks that hold rows back
+	// deliver them, so each run's rows are out even when the process keeps
+	// running with -watch.
+	Flush() error
+	Close() error
+}
+
+// OutputConfig configures a single sink.
+type OutputConfig struct {
+	// Type is "db" (default), "csv", "ndjson", "stdout", "elasticsearch",
+	// "kafka" or "s3". It defaults to
+	// "ndjson" when Target is stdout.
+	Type string `json:"type"`
+	// Target is the file path for file-based sinks, or "stdout" (or "-")
+	// to write to standard output.
+	Target string `json:"target"`
+
+	Kafka         KafkaConfig         `json:"kafka"`
+	S3            S3Config            `json:"s3"`
+	Elasticsearch ElasticsearchConfig `json:"elasticsearch"`
+}
+
+// KafkaConfig configures the "kafka" sink, which is only available in
+// binaries built with the kafka build tag.
+type KafkaConfig struct {
+	Brokers []string `json:"brokers"`
+	Topic   string   `json:"topic"`
+	// BatchSize and BatchTimeoutMs control how many messages are buffered,
+	// and for how long, before a write to the brokers.
+	BatchSize      int  `json:"batchSize"`
+	BatchTimeoutMs int  `json:"batchTimeoutMs"`
+	TLS            bool `json:"tls"`
+	SASL           struct {
+		// Mechanism is "plain", "scram-sha-256" or "scram-sha-512".
+		Mechanism string `json:"mechanism"`
+		Username  string `json:"username"`
+		Password  string `json:"password"`
+	} `json:"sasl"`
+}
+
+// S3Config configures the "s3" sink, which is only available in binaries
+// built with the s3 build tag. Credentials are resolved the standard AWS way
+// (environment, shared config, instance role).
+type S3Config struct {
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix"`
+	Region string `json:"region"`
+	// Endpoint overrides the S3 endpoint, e.g. for MinIO. Path-style
+	// addressing is used when it is set.
+	Endpoint string `json:"endpoint"`
+	Gzip     bool   `json:"gzip"`
+}
+
+// sinkFactories holds sinks that are compiled in behind build tags.
+var sinkFactories = map[string]func(OutputConfig) (Sink, error){}
+
+// taggedSinks maps sink types to the build tag that enables them.
+var taggedSinks = map[string]string{
+	"kafka": "kafka",
+	"s3":    "s3",
+}
+
+// multiSink fans each row out to every configured sink. A failing sink does
+// not stop the others from receiving the row.
+type multiSink []Sink
+
+func (m multiSink) Write(data CdnShareData) error {
+	var errs []error
+	for _, s := range m {
+		if err := s.Write(data); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m multiSink) Flush() error {
+	var errs []error
+	for _, s := range m {
+		if err := s.Flush(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m multiSink) Close() error {
+	var errs []error
+	for _, s := range m {
+		if err := s.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// openSinks constructs the sinks described by outputs. In dry-run mode only
+// stdout sinks are opened.
+func openSinks(outputs []OutputConfig) (multiSink, error) {
+	var sinks multiSink
+	for _, o := range outputs {
+		if o.Type == "stdout" || (o.Type == "" && isStdout(o.Target)) {
+			o.Type, o.Target = "ndjson", "stdout"
+		}
+
+		if dryRun && !isStdout(o.Target) {
+			slog.Info("Dry run: rows will not be written", "output", o.Type, "target", o.Target)
+			continue
+		}
+
+		s, err := openSink(o)
+		if err != nil {
+			sinks.Close()
+			return nil, fmt.Errorf("error opening %s output %q: %w", o.Type, o.Target, err)
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
+
+func openSink(o OutputConfig) (Sink, error) {
+	switch o.Type {
+	case "", "db":
+		return newMySQLSink()
+	case "csv":
+		return newCSVSink(o.Target)
+	case "ndjson":
+		return newNDJSONSink(o.Target)
+	case "elasticsearch":
+		return newElasticsearchSink(o.Elasticsearch)
+	}
+
+	if f, ok := sinkFactories[o.Type]; ok {
+		return f(o)
+	}
+	if tag, ok := taggedSinks[o.Type]; ok {
+		return nil, fmt.Errorf("%s output requires building with -tags %s", o.Type, tag)
+	}
+	return nil, fmt.Errorf("unknown output type %q", o.Type)
+}
+
+// mySQLSink writes rows to each account's table in the configured database.
+// Everything it does goes through db, so the rest of the pipeline only
+// depends on the Sink interface.
+type mySQLSink struct {
+	db *sql.DB
+}
+
+// newMySQLSink opens the package-level database handle, which retention and
+// health checks share, and hands it to the sink.
+func newMySQLSink() (*mySQLSink, error) {
+	if err := openDB(); err != nil {
+		return nil, err
+	}
+	return &mySQLSink{db: db}, nil
+}
+
+// openDB opens the package-level database handle if it isn't open yet.
+func openDB() error {
+	if db != nil {
+		return nil
+	}
+
+	dsn, err := databaseDSN()
+	if err != nil {
+		return err
+	}
+	db, err = sql.Open("mysql", dsn)
+	return err
+}
+
+// databaseDSN returns the mysql driver DSN for config.Database, registering
+// its TLS config if it has one.
+func databaseDSN() (string, error) {
+	address := fmt.Sprintf("tcp(%s:%s)", config.Database.Host, config.Database.Port)
+	if config.Database.Socket != "" {
+		address = fmt.Sprintf("unix(%s)", config.Database.Socket)
+	}
+
+	// parseTime lets DATETIME columns be scanned into time.Time.
+	dsn := fmt.Sprintf("%s:%s@%s/%s?parseTime=true", config.Database.User, config.Database.Password, address, config.Database.Database)
+
+	tlsParam, err := registerDBTLS(config.Database.TLS, config.Database.Host)
+	if err != nil {
+		return "", err
+	}
+	if tlsParam != "" {
+		dsn += "&tls=" + tlsParam
+	}
+	// The driver converts times to loc when writing and reading DATETIME
+	// columns, so stored timestamps are in the configured timezone.
+	if timestampLocation != time.UTC {
+		dsn += "&loc=" + url.QueryEscape(timestampLocation.String())
+	}
+	return dsn, nil
+}
+
+func (s *mySQLSink) Write(data CdnShareData) error {
+	if config.ChangeDetection.Enabled {
+		if err := ensureTableExists(s.db, data.table, observationSchema()); err != nil {
+			return fmt.Errorf("error ensuring table exists: %w", err)
+		}
+		if err := detectCDNChange(s.db, data.table, data); err != nil {
+			slog.Error("Error detecting CDN change", "account", data.AccountName, "hostname", data.CustomerHostname, "error", err)
+		}
+	}
+	if err := saveData(s.db, data.table, data); err != nil {
+		return err
+	}
+	if config.Database.RawWhois {
+		if err := saveRawWhois(s.db, data); err != nil {
+			slog.Error("Error saving raw WHOIS", "account", data.AccountName, "ip", data.CdnIp, "error", err)
+		}
+	}
+	return nil
+}
+
+// Flush does nothing: rows are inserted as they are written.
+func (s *mySQLSink) Flush() error { return nil }
+
+// Close closes the statements the sink prepared. The database handle is
+// shared with retention and health checks, so it stays open.
+func (s *mySQLSink) Close() error {
+	closeInsertStmts(s.db)
+	return nil
+}
+
+// memorySink keeps rows in memory, standing in for a database in tests.
+type memorySink struct {
+	mu   sync.Mutex
+	rows []CdnShareData
+}
+
+func (s *memorySink) Write(data CdnShareData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rows = append(s.rows, data)
+	return nil
+}
+
+// Rows returns a copy of the rows written so far.
+func (s *memorySink) Rows() []CdnShareData {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.rows)
+}
+
+func (s *memorySink) Flush() error { return nil }
+func (s *memorySink) Close() error { return nil }
+
+var csvHeader = []string{"timestamp", "cdn_ip", "hostname", "cdn_orgname", "stream_type", "account_name", "account_unit", "account_id", "request_method", "resource_type", "cdn_providers", "multi_cdn", "matched_url", "websocket", "latency_ms", "time_to_first_segment_ms", "stream_type_source", "confidence", "alternatives", "tls_issuer", "prefix", "outcome", "emulation_profile"}
+
+// isStdout reports whether an output target refers to standard output.
+func isStdout(target string) bool {
+	return target == "-" || target == "stdout"
+}
+
+// openOutput opens target for appending, or returns stdout for "-" and
+// "stdout". The returned bool is true when nothing has been written to the
+// target yet.
+func openOutput(target string) (io.WriteCloser, bool, error) {
+	if isStdout(target) {
+		return nopCloser{os.Stdout}, true, nil
+	}
+
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, false, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, false, err
+	}
+	return f, info.Size() == 0, nil
+}
+
+// csvSink streams rows to a CSV file. Accounts run in parallel, so writes
+// are serialized with a mutex and flushed per row.
+type csvSink struct {
+	mu sync.Mutex
+	f  io.WriteCloser
+	w  *csv.Writer
+}
+
+// newCSVSink opens target for appending, writing the header row if the
+// file is new or empty. A file written with different columns, by an older
+// version, is moved aside first, so rows never land under the wrong header.
+func newCSVSink(target string) (*csvSink, error) {
+	if !isStdout(target) {
+		if err := rotateStaleCSV(target); err != nil {
+			return nil, err
+		}
+	}
+
+	f, empty, err := openOutput(target)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &csvSink{f: f, w: csv.NewWriter(f)}
+	if empty {
+		if err := o.w.Write(csvHeader); err != nil {
+			f.Close()
+			return nil, err
+		}
+		o.w.Flush()
+	}
+	return o, nil
+}
+
+// rotateStaleCSV renames target to a timestamped name alongside it if its
+// header row isn't csvHeader.
+func rotateStaleCSV(target string) error {
+	f, err := os.Open(target)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	f.Close()
+	if err == io.EOF || (err == nil && slices.Equal(header, csvHeader)) {
+		return nil
+	}
+
+	ext := filepath.Ext(target)
+	rotated := strings.TrimSuffix(target, ext) + "." + time.Now().Format("20060102-150405") + ext
+	if err := os.Rename(target, rotated); err != nil {
+		return fmt.Errorf("error moving aside %s, which has different columns: %w", target, err)
+	}
+	slog.Warn("Moved aside CSV output with different columns", "path", target, "moved_to", rotated)
+	return nil
+}
+
+func (o *csvSink) Write(data CdnShareData) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	err := o.w.Write(csvRecord(data))
+	if err != nil {
+		return err
+	}
+
+	o.w.Flush()
+	return o.w.Error()
+}
+
+// csvFloat and csvInt format an unset (zero) measurement as an empty
+// field.
+func csvFloat(v float64) string {
+	if v == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func csvInt(v int64) string {
+	if v == 0 {
+		return ""
+	}
+	return strconv.FormatInt(v, 10)
+}
+
+// csvRecord returns the csvHeader columns of data.
+func csvRecord(data CdnShareData) []string {
+	return []string{
+		data.Timestamp.Format(time.RFC3339),
+		data.CdnIp,
+		data.CustomerHostname,
+		data.CdnOrgName,
+		data.CustomerStreamType,
+		data.AccountName,
+		data.AccountUnit,
+		data.AccountID,
+		data.RequestMethod,
+		data.ResourceType,
+		data.CdnProviders,
+		strconv.FormatBool(data.MultiCDN),
+		data.MatchedURL,
+		strconv.FormatBool(data.WebSocket),
+		csvFloat(data.LatencyMs),
+		csvInt(data.TimeToFirstSegmentMs),
+		data.StreamTypeSource,
+		csvFloat(data.Confidence),
+		candidatesJSON(data.Alternatives),
+		data.TLSIssuer,
+		data.Prefix,
+		data.Outcome,
+		data.EmulationProfile,
+	}
+}
+
+// Flush does nothing: Write already flushes every row.
+func (o *csvSink) Flush() error { return nil }
+
+func (o *csvSink) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.w.Flush()
+	if err := o.w.Error(); err != nil {
+		o.f.Close()
+		return err
+	}
+	return o.f.Close()
+}
+
+// ndjsonSink writes one JSON object per row, to a file or to stdout.
+type ndjsonSink struct {
+	mu  sync.Mutex
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+// newNDJSONSink appends to target, or writes to stdout.
+func newNDJSONSink(target string) (*ndjsonSink, error) {
+	f, _, err := openOutput(target)
+	if err != nil {
+		return nil, err
+	}
+	return &ndjsonSink{w: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (o *ndjsonSink) Write(data CdnShareData) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.enc.Encode(data)
+}
+
+// Flush does nothing: rows are written unbuffered.
+func (o *ndjsonSink) Flush() error { return nil }
+
+func (o *ndjsonSink) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.w.Close()
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ElasticsearchConfig configures the "elasticsearch" sink.
+type ElasticsearchConfig struct {
+	URL string `json:"url"`
+	// Index is the target index. A Go time layout in braces is expanded
+	// from each row's timestamp, e.g. "cdnshare-{2006.01}" gives
+	// "cdnshare-2024.01".
+	Index    string `json:"index"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	APIKey   string `json:"apiKey"`
+	// BatchSize and FlushIntervalMs bound how many documents are buffered,
+	// and for how long, before a bulk request.
+	BatchSize       int `json:"batchSize"`
+	FlushIntervalMs int `json:"flushIntervalMs"`
+}
+
+var indexDatePattern = regexp.MustCompile(`\{([^}]*)\}`)
+
+// esSink indexes rows into Elasticsearch using the bulk API.
+type esSink struct {
+	cfg    ElasticsearchConfig
+	client *http.Client
+
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	docs int
+
+	// sending serializes flushes, so a requeued batch goes out before the
+	// documents written after it.
+	sending sync.Mutex
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newElasticsearchSink(cfg ElasticsearchConfig) (*esSink, error) {
+	if cfg.URL == "" || cfg.Index == "" {
+		return nil, fmt.Errorf("elasticsearch output requires a url and an index")
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 500
+	}
+	if cfg.FlushIntervalMs <= 0 {
+		cfg.FlushIntervalMs = 5000
+	}
+	cfg.URL = strings.TrimRight(cfg.URL, "/")
+
+	s := &esSink{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 30 * time.Second},
+		done:   make(chan struct{}),
+	}
+
+	if err := s.putIndexTemplate(); err != nil {
+		return nil, err
+	}
+
+	s.wg.Add(1)
+	go s.flushLoop()
+	return s, nil
+}
+
+// putIndexTemplate maps the timestamp field as a date for every index the
+// configured pattern can expand to.
+func (s *esSink) putIndexTemplate() error {
+	pattern := indexDatePattern.ReplaceAllString(s.cfg.Index, "*")
+	name := strings.Trim(indexDatePattern.ReplaceAllString(s.cfg.Index, ""), "-_.")
+
+	body, err := json.Marshal(map[string]any{
+		"index_patterns": []string{pattern},
+		"template": map[string]any{
+			"mappings": map[string]any{
+				"properties": map[string]any{
+					"timestamp": map[string]string{"type": "date"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(http.MethodPut, "/_index_template/"+name, "application/json", body)
+	if err != nil {
+		return fmt.Errorf("error creating index template: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *esSink) index(t time.Time) string {
+	return indexDatePattern.ReplaceAllStringFunc(s.cfg.Index, func(m string) string {
+		return t.Format(m[1 : len(m)-1])
+	})
+}
+
+func (s *esSink) Write(data CdnShareData) error {
+	doc, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	action, err := json.Marshal(map[string]any{
+		"index": map[string]string{"_index": s.index(data.Timestamp)},
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.buf.Write(action)
+	s.buf.WriteByte('\n')
+	s.buf.Write(doc)
+	s.buf.WriteByte('\n')
+	s.docs++
+	full := s.docs >= s.cfg.BatchSize
+	s.mu.Unlock()
+
+	if full {
+		return s.flush()
+	}
+	return nil
+}
+
+func (s *esSink) flushLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(s.cfg.FlushIntervalMs) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.flush(); err != nil {
+				slog.Error("Error flushing to elasticsearch", "error", err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// flush sends the buffered documents in one bulk request. Items that fail
+// are logged individually; the rest of the batch is kept. If the request
+// itself fails, the batch is requeued and sent again by the next flush.
+func (s *esSink) flush() error {
+	s.sending.Lock()
+	defer s.sending.Unlock()
+
+	s.mu.Lock()
+	if s.docs == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	body, docs := bytes.Clone(s.buf.Bytes()), s.docs
+	s.buf.Reset()
+	s.docs = 0
+	s.mu.Unlock()
+
+	resp, err := s.do(http.MethodPost, "/_bulk", "application/x-ndjson", body)
+	if err != nil {
+		s.requeue(body, docs)
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Index  string          `json:"_index"`
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("error decoding bulk response: %w", err)
+	}
+
+	if result.Errors {
+		for _, item := range result.Items {
+			for _, r := range item {
+				if r.Status >= 300 {
+					slog.Error("Elasticsearch rejected document", "index", r.Index, "status", r.Status, "error", string(r.Error))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// requeue puts a batch that failed to send back in front of the documents
+// buffered since.
+func (s *esSink) requeue(body []byte, docs int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rest := bytes.Clone(s.buf.Bytes())
+	s.buf.Reset()
+	s.buf.Write(body)
+	s.buf.Write(rest)
+	s.docs += docs
+}
+
+func (s *esSink) do(method, path, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.cfg.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	switch {
+	case s.cfg.APIKey != "":
+		req.Header.Set("Authorization", "ApiKey "+s.cfg.APIKey)
+	case s.cfg.Username != "":
+		req.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, b)
+	}
+	return resp, nil
+}
+
+// Flush sends the buffered documents.
+func (s *esSink) Flush() error {
+	return s.flush()
+}
+
+// Close stops the flush loop and sends any remaining documents.
+func (s *esSink) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	return s.flush()
+}
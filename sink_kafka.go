@@ -0,0 +1,98 @@
+//go:build kafka
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+func init() {
+	sinkFactories["kafka"] = func(o OutputConfig) (Sink, error) {
+		return newKafkaSink(o.Kafka)
+	}
+}
+
+// kafkaSink publishes each row as a JSON message keyed by hostname, so all
+// observations for a host land on the same partition.
+type kafkaSink struct {
+	w *kafka.Writer
+}
+
+func newKafkaSink(cfg KafkaConfig) (*kafkaSink, error) {
+	if len(cfg.Brokers) == 0 || cfg.Topic == "" {
+		return nil, errors.New("kafka output requires brokers and a topic")
+	}
+
+	transport := &kafka.Transport{}
+	if cfg.TLS {
+		transport.TLS = &tls.Config{}
+	}
+	if cfg.SASL.Mechanism != "" {
+		mechanism, err := kafkaSASLMechanism(cfg.SASL.Mechanism, cfg.SASL.Username, cfg.SASL.Password)
+		if err != nil {
+			return nil, err
+		}
+		transport.SASL = mechanism
+	}
+
+	w := &kafka.Writer{
+		Addr:         kafka.TCP(cfg.Brokers...),
+		Topic:        cfg.Topic,
+		Balancer:     &kafka.Hash{},
+		BatchSize:    cfg.BatchSize,
+		BatchTimeout: time.Duration(cfg.BatchTimeoutMs) * time.Millisecond,
+		Async:        true,
+		Transport:    transport,
+		Completion: func(messages []kafka.Message, err error) {
+			if err != nil {
+				slog.Error("Error publishing to kafka", "topic", cfg.Topic, "messages", len(messages), "error", err)
+			}
+		},
+	}
+	return &kafkaSink{w: w}, nil
+}
+
+func kafkaSASLMechanism(name, user, password string) (sasl.Mechanism, error) {
+	switch name {
+	case "plain":
+		return plain.Mechanism{Username: user, Password: password}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, user, password)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, user, password)
+	default:
+		return nil, fmt.Errorf("unknown kafka SASL mechanism %q", name)
+	}
+}
+
+func (s *kafkaSink) Write(data CdnShareData) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return s.w.WriteMessages(context.Background(), kafka.Message{
+		Key:   []byte(data.CustomerHostname),
+		Value: b,
+	})
+}
+
+// Flush does nothing: the async writer sends each batch within
+// batchTimeoutMs, and kafka-go has no way to force it sooner short of
+// closing the writer.
+func (s *kafkaSink) Flush() error { return nil }
+
+// Close flushes any buffered messages before closing the writer.
+func (s *kafkaSink) Close() error {
+	return s.w.Close()
+}
@@ -0,0 +1,146 @@
+//go:build s3
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func init() {
+	sinkFactories["s3"] = func(o OutputConfig) (Sink, error) {
+		return newS3Sink(o.S3)
+	}
+}
+
+// s3Sink buffers a run's rows and uploads them as a single NDJSON object
+// when flushed at the end of the run, giving an immutable snapshot per run.
+type s3Sink struct {
+	cfg    S3Config
+	client *s3.Client
+
+	mu      sync.Mutex
+	started time.Time
+	buf     bytes.Buffer
+	w       io.Writer
+	gz      *gzip.Writer
+	enc     *json.Encoder
+	rows    int
+}
+
+func newS3Sink(cfg S3Config) (*s3Sink, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("s3 output requires a bucket")
+	}
+
+	var opts []func(*awsconfig.LoadOptions) error
+	if cfg.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(cfg.Region))
+	}
+
+	awsCfg, err := awsconfig.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+			o.UsePathStyle = true
+		}
+	})
+
+	s := &s3Sink{cfg: cfg, client: client, started: time.Now().UTC()}
+	s.startWriter()
+	return s, nil
+}
+
+// startWriter sets up the encoder appending to buf, through a new gzip
+// stream when compressing.
+func (s *s3Sink) startWriter() {
+	s.w = &s.buf
+	s.gz = nil
+	if s.cfg.Gzip {
+		s.gz = gzip.NewWriter(&s.buf)
+		s.w = s.gz
+	}
+	s.enc = json.NewEncoder(s.w)
+}
+
+func (s *s3Sink) Write(data CdnShareData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.enc.Encode(data); err != nil {
+		return err
+	}
+	s.rows++
+	return nil
+}
+
+// key returns the object key for the current run, e.g.
+// prefix/2024/01/02/cdnshare-20240102T150405Z.ndjson.gz.
+func (s *s3Sink) key() string {
+	name := "cdnshare-" + s.started.Format("20060102T150405Z") + ".ndjson"
+	if s.cfg.Gzip {
+		name += ".gz"
+	}
+	return path.Join(s.cfg.Prefix, s.started.Format("2006/01/02"), name)
+}
+
+// Flush uploads the rows buffered since the last flush as one object and
+// starts the next run's. Nothing is uploaded for an empty run. If the
+// upload fails, the rows are kept and go out with the next flush.
+func (s *s3Sink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rows == 0 {
+		s.started = time.Now().UTC()
+		return nil
+	}
+	if s.gz != nil {
+		if err := s.gz.Close(); err != nil {
+			return err
+		}
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(s.cfg.Bucket),
+		Key:         aws.String(s.key()),
+		Body:        bytes.NewReader(s.buf.Bytes()),
+		ContentType: aws.String("application/x-ndjson"),
+	}
+	if s.cfg.Gzip {
+		input.ContentEncoding = aws.String("gzip")
+	}
+
+	if _, err := s.client.PutObject(context.Background(), input); err != nil {
+		// A closed gzip stream can't be appended to, so later rows start
+		// a new gzip member, which readers decode as one stream.
+		s.startWriter()
+		return err
+	}
+
+	s.buf.Reset()
+	s.rows = 0
+	s.started = time.Now().UTC()
+	s.startWriter()
+	return nil
+}
+
+// Close uploads any rows not flushed yet.
+func (s *s3Sink) Close() error {
+	return s.Flush()
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEnsureTableExistsChecksOnce(t *testing.T) {
+	conn, f := openFakeDB(t)
+	table := fmt.Sprintf("ensure_once_%d", time.Now().UnixNano())
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ensureTableExists(conn, table, observationSchema()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := ensureTableExists(conn, table, observationSchema()); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := f.count("information_schema.tables"); n != 1 {
+		t.Errorf("table existence checked %d times, want 1", n)
+	}
+}
+
+func testObservation(table string) CdnShareData {
+	return CdnShareData{
+		Timestamp:          time.Now(),
+		CdnIp:              "192.0.2.10",
+		CustomerHostname:   "cdn.example.com",
+		CdnOrgName:         "Example CDN",
+		CustomerStreamType: "hls",
+		AccountName:        "example",
+		AccountID:          "1",
+		table:              table,
+	}
+}
+
+func TestSaveDataPreparesOnce(t *testing.T) {
+	conn, f := openFakeDB(t)
+	table := fmt.Sprintf("prepare_once_%d", time.Now().UnixNano())
+
+	for range 5 {
+		if err := saveData(conn, table, testObservation(table)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := f.count("INSERT INTO " + table); n != 5 {
+		t.Errorf("%d inserts run, want 5", n)
+	}
+	if f.prepared != 1 {
+		t.Errorf("insert prepared %d times, want 1", f.prepared)
+	}
+}
+
+func BenchmarkSaveData(b *testing.B) {
+	conn, _ := openFakeDB(b)
+	table := fmt.Sprintf("bench_insert_%d", time.Now().UnixNano())
+	data := testObservation(table)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		if err := saveData(conn, table, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMySQLSinkCloseKeepsSharedHandle(t *testing.T) {
+	connA, fa := openFakeDB(t)
+	connB, fb := openFakeDB(t)
+	table := fmt.Sprintf("sink_close_%d", time.Now().UnixNano())
+	for _, conn := range []*sql.DB{connA, connB} {
+		if err := saveData(conn, table, testObservation(table)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := (&mySQLSink{db: connA}).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if fa.closed != 1 || fb.closed != 0 {
+		t.Errorf("closed %d and %d statements, want only the sink's 1", fa.closed, fb.closed)
+	}
+	if err := connA.Ping(); err != nil {
+		t.Errorf("shared handle closed with the sink: %v", err)
+	}
+	if err := saveData(connA, table, testObservation(table)); err != nil {
+		t.Errorf("insert after closing the sink: %v", err)
+	}
+}
+
+func TestNewCSVSinkRotatesStaleHeader(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "cdnshare.csv")
+	stale := "timestamp,cdn_ip,hostname\n2024-01-02 03:04:05,192.0.2.10,cdn.example.com\n"
+	if err := os.WriteFile(target, []byte(stale), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newCSVSink(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(testObservation("")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := filepath.Glob(filepath.Join(dir, "cdnshare.*.csv"))
+	if err != nil || len(rotated) != 1 {
+		t.Fatalf("rotated files = %v (%v), want one", rotated, err)
+	}
+	if b, err := os.ReadFile(rotated[0]); err != nil || string(b) != stale {
+		t.Errorf("rotated file = %q (%v), want the stale file unchanged", b, err)
+	}
+
+	records, err := csv.NewReader(mustOpen(t, target)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || !slices.Equal(records[0], csvHeader) {
+		t.Errorf("new file = %q, want the current header and one row", records)
+	}
+}
+
+func TestNewCSVSinkAppendsMatchingHeader(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "cdnshare.csv")
+	for range 2 {
+		s, err := newCSVSink(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Write(testObservation("")); err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+	}
+
+	records, err := csv.NewReader(mustOpen(t, target)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Errorf("%d records, want a header and two rows", len(records))
+	}
+}
+
+func mustOpen(t *testing.T, name string) *os.File {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+// flushCounter is a sink that counts its flushes.
+type flushCounter struct {
+	memorySink
+	flushes int
+}
+
+func (s *flushCounter) Flush() error {
+	s.flushes++
+	return nil
+}
+
+func TestMultiSinkFlushesEveryOutput(t *testing.T) {
+	a, b := new(flushCounter), new(flushCounter)
+	if err := (multiSink{a, b}).Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if a.flushes != 1 || b.flushes != 1 {
+		t.Errorf("flushed %d and %d times, want 1 each", a.flushes, b.flushes)
+	}
+}
+
+func TestCSVRecordMatchesHeader(t *testing.T) {
+	data := testObservation("")
+	data.Prefix, data.Outcome, data.EmulationProfile = "192.0.2.0/24", outcomeOK, "iPhone 14"
+
+	record := csvRecord(data)
+	if len(record) != len(csvHeader) {
+		t.Fatalf("%d fields for %d columns", len(record), len(csvHeader))
+	}
+	for column, want := range map[string]string{"prefix": data.Prefix, "outcome": data.Outcome, "emulation_profile": data.EmulationProfile} {
+		if got := record[slices.Index(csvHeader, column)]; got != want {
+			t.Errorf("%s = %q, want %q", column, got, want)
+		}
+	}
+}
+
+func TestElasticsearchFlushRequeuesFailedBatch(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		fail    = true
+		indexed int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_bulk" {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		indexed += strings.Count(string(b), "\n") / 2
+		io.WriteString(w, `{"errors":false,"items":[]}`)
+	}))
+	defer srv.Close()
+
+	s, err := newElasticsearchSink(ElasticsearchConfig{URL: srv.URL, Index: "cdnshare", BatchSize: 100, FlushIntervalMs: 60_000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(testObservation("")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err == nil {
+		t.Fatal("Flush() succeeded against a failing server")
+	}
+
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	if err := s.Write(testObservation("")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if indexed != 2 {
+		t.Errorf("%d documents indexed, want the failed one and the next", indexed)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// SlackConfig configures Slack notifications via an incoming webhook.
+type SlackConfig struct {
+	WebhookURL string `json:"webhookUrl"`
+	// Events lists what to notify on: "run_errors" and/or "cdn_change".
+	Events []string `json:"events"`
+	// MinIntervalSeconds is the minimum gap between CDN change messages.
+	// Changes inside the gap are counted and reported with the next one.
+	MinIntervalSeconds int `json:"minIntervalSeconds"`
+}
+
+func (c SlackConfig) enabled(event string) bool {
+	return c.WebhookURL != "" && slices.Contains(c.Events, event)
+}
+
+// slackLimiter drops CDN change messages that arrive too quickly so a mass
+// migration doesn't flood the channel.
+var slackLimiter struct {
+	mu         sync.Mutex
+	last       time.Time
+	suppressed int
+}
+
+// allowSlackChange reports whether a change message may be sent now, and how
+// many earlier messages were suppressed.
+func allowSlackChange(interval time.Duration) (bool, int) {
+	slackLimiter.mu.Lock()
+	defer slackLimiter.mu.Unlock()
+
+	if time.Since(slackLimiter.last) < interval {
+		slackLimiter.suppressed++
+		return false, 0
+	}
+
+	suppressed := slackLimiter.suppressed
+	slackLimiter.last = time.Now()
+	slackLimiter.suppressed = 0
+	return true, suppressed
+}
+
+func postSlack(text string) error {
+	return postWebhook(WebhookConfig{URL: config.Slack.WebhookURL}, map[string]string{"text": text})
+}
+
+func notifySlackCDNChange(change CDNChange) {
+	ok, suppressed := allowSlackChange(time.Duration(config.Slack.MinIntervalSeconds) * time.Second)
+	if !ok {
+		return
+	}
+
+	text := fmt.Sprintf(":arrows_counterclockwise: CDN change for *%s* (%s): `%s` %s moved from *%s* to *%s*",
+		change.AccountName, change.AccountID, change.Hostname, change.StreamType, change.OldCdnOrg, change.NewCdnOrg)
+	if suppressed > 0 {
+		text += fmt.Sprintf("\n_%d more changes were not posted to avoid flooding the channel._", suppressed)
+	}
+
+	if err := postSlack(text); err != nil {
+		slog.Error("Error sending Slack notification", "account", change.AccountName, "hostname", change.Hostname, "error", err)
+	}
+}
+
+// notifySlackRunErrors posts a summary of a run that finished with errors.
+func notifySlackRunErrors(r RunSummary) {
+	if !config.Slack.enabled("run_errors") || r.Errors == 0 {
+		return
+	}
+
+	text := fmt.Sprintf(":warning: cdnshare run finished with %d errors (%d URLs visited, %d requests matched, %d rows written)",
+		r.Errors, r.URLsVisited, r.RequestsMatched, r.RowsWritten)
+
+	if err := postSlack(text); err != nil {
+		slog.Error("Error sending Slack notification", "error", err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"path"
+	"strings"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+)
+
+// Sources recorded in CdnShareData.StreamTypeSource when stream type
+// detection is enabled.
+const (
+	streamTypeFromConfig = "config"
+	streamTypeFromHLS    = "hls"
+	streamTypeFromDASH   = "dash"
+)
+
+// manifestKind reports whether a response is an HLS or DASH manifest, or ""
+// if it is neither.
+func manifestKind(u, mimeType string) string {
+	mimeType = strings.ToLower(mimeType)
+	switch {
+	case strings.Contains(mimeType, "mpegurl"):
+		return streamTypeFromHLS
+	case strings.Contains(mimeType, "dash+xml"):
+		return streamTypeFromDASH
+	}
+
+	p := u
+	if i := strings.IndexAny(p, "?#"); i >= 0 {
+		p = p[:i]
+	}
+	switch strings.ToLower(path.Ext(p)) {
+	case ".m3u8":
+		return streamTypeFromHLS
+	case ".mpd":
+		return streamTypeFromDASH
+	}
+	return ""
+}
+
+// classifyManifest returns "live" or "ondemand" for a manifest body, or ""
+// when it can't tell, e.g. for an HLS master playlist.
+func classifyManifest(kind string, body []byte) string {
+	switch kind {
+	case streamTypeFromHLS:
+		switch {
+		case bytes.Contains(body, []byte("#EXT-X-PLAYLIST-TYPE:VOD")), bytes.Contains(body, []byte("#EXT-X-ENDLIST")):
+			return "ondemand"
+		case bytes.Contains(body, []byte("#EXT-X-PLAYLIST-TYPE:EVENT")), bytes.Contains(body, []byte("#EXTINF")):
+			return "live"
+		}
+	case streamTypeFromDASH:
+		switch {
+		case bytes.Contains(body, []byte(`type="dynamic"`)):
+			return "live"
+		case bytes.Contains(body, []byte("<MPD")):
+			// MPD@type defaults to static.
+			return "ondemand"
+		}
+	}
+	return ""
+}
+
+// noteManifest remembers manifest responses so their bodies can be
+// classified once they have finished loading.
+func (c *capture) noteManifest(ev *network.EventResponseReceived) {
+	kind := manifestKind(ev.Response.URL, ev.Response.MimeType)
+	if kind == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.manifests == nil {
+		c.manifests = make(map[network.RequestID]string)
+	}
+	c.manifests[ev.RequestID] = kind
+}
+
+// classifyLoadedManifest fetches the body of a finished manifest response
+// and, if it is conclusive, sets the capture's stream type. The first
+// conclusive manifest wins.
+func (c *capture) classifyLoadedManifest(ctx context.Context, id network.RequestID) {
+	c.mu.Lock()
+	kind, ok := c.manifests[id]
+	delete(c.manifests, id)
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	// Event handlers must not block, so fetch the body in the background.
+	go func() {
+		body, err := network.GetResponseBody(id).Do(cdp.WithExecutor(ctx, chromedp.FromContext(ctx).Target))
+		if err != nil {
+			slog.Debug("Error reading manifest", "account", c.account.Name, "url", c.url, "error", err)
+			return
+		}
+
+		streamType := classifyManifest(kind, body)
+		if streamType == "" {
+			return
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.detectedStreamType != "" {
+			return
+		}
+		c.detectedStreamType, c.streamTypeSource = streamType, kind
+		if streamType != c.streamType {
+			slog.Info("Detected stream type differs from config", "account", c.account.Name, "url", c.url, "configured", c.streamType, "detected", streamType, "source", kind)
+		}
+	}()
+}
+
+// currentStreamType returns the stream type to record and where it came
+// from. Without detection, or until a manifest has been classified, it is
+// the configured type.
+func (c *capture) currentStreamType() (string, string) {
+	if !c.account.DetectStreamType {
+		return c.streamType, ""
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.detectedStreamType != "" {
+		return c.detectedStreamType, c.streamTypeSource
+	}
+	return c.streamType, streamTypeFromConfig
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RunSummary is a point-in-time view of what a collection run did.
+type RunSummary struct {
+	StartedAt       time.Time `json:"startedAt"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	URLsVisited     int       `json:"urlsVisited"`
+	RequestsMatched int       `json:"requestsMatched"`
+	UniqueIPs       int       `json:"uniqueIps"`
+	UniqueCdnOrgs   int       `json:"uniqueCdnOrgs"`
+	CacheHits       int       `json:"cacheHits"`
+	CacheMisses     int       `json:"cacheMisses"`
+	RowsWritten     int       `json:"rowsWritten"`
+	Errors          int       `json:"errors"`
+	// URLsWithoutMatches counts URLs where no request matched the media
+	// filters, usually a sign the site's segment URLs have changed.
+	URLsWithoutMatches int `json:"urlsWithoutMatches"`
+	// URLsCapped counts URLs whose capture ended at maxCapturesPerURL.
+	URLsCapped int `json:"urlsCapped"`
+	// Lookups counts provider calls, and LookupsOverBudget the cache misses
+	// skipped because lookup.maxLookups had been reached.
+	Lookups           int `json:"lookups"`
+	LookupsOverBudget int `json:"lookupsOverBudget"`
+	// EstimatedLookups is the pre-run estimate of fresh lookups, and
+	// LookupCost the cost of Lookups at lookup.costPerLookup.
+	EstimatedLookups int     `json:"estimatedLookups"`
+	LookupCost       float64 `json:"lookupCost,omitempty"`
+	// IPInfoTokenUsage counts ipinfo lookups per (masked) token.
+	IPInfoTokenUsage map[string]int `json:"ipinfoTokenUsage,omitempty"`
+	// CDNDistribution is the share of each account's hostnames served by
+	// each CDN org.
+	CDNDistribution []CDNShare `json:"cdnDistribution,omitempty"`
+}
+
+// CDNShare is how many of an account's distinct hostnames were seen on a
+// CDN org this run, and what percentage of the account's hostnames that
+// is. A hostname seen on several orgs counts for each, so an account's
+// percentages can add up to more than 100.
+type CDNShare struct {
+	Account   string  `json:"account"`
+	CdnOrg    string  `json:"cdnOrg"`
+	Hostnames int     `json:"hostnames"`
+	Percent   float64 `json:"percent"`
+}
+
+// runStats accumulates per-run counters from the account goroutines.
+type runStats struct {
+	mu      sync.Mutex
+	summary RunSummary
+	ips     map[string]struct{}
+	orgs    map[string]struct{}
+	// hostnames holds the hostnames seen per account and CDN org.
+	hostnames map[string]map[string]map[string]struct{}
+}
+
+func newRunStats() *runStats {
+	return &runStats{
+		summary: RunSummary{StartedAt: time.Now()},
+		ips:     make(map[string]struct{}),
+		orgs:    make(map[string]struct{}),
+
+		hostnames: make(map[string]map[string]map[string]struct{}),
+	}
+}
+
+// reset starts a new run, for watch mode.
+func (s *runStats) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.summary = RunSummary{StartedAt: time.Now()}
+	s.ips = make(map[string]struct{})
+	s.orgs = make(map[string]struct{})
+	s.hostnames = make(map[string]map[string]map[string]struct{})
+}
+
+func (s *runStats) add(f func(*RunSummary)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(&s.summary)
+}
+
+func (s *runStats) urlVisited()     { s.add(func(r *RunSummary) { r.URLsVisited++ }) }
+func (s *runStats) requestMatched() { s.add(func(r *RunSummary) { r.RequestsMatched++ }) }
+func (s *runStats) cacheHit()       { s.add(func(r *RunSummary) { r.CacheHits++ }) }
+func (s *runStats) cacheMiss()      { s.add(func(r *RunSummary) { r.CacheMisses++ }) }
+func (s *runStats) rowWritten()     { s.add(func(r *RunSummary) { r.RowsWritten++ }) }
+func (s *runStats) error()          { s.add(func(r *RunSummary) { r.Errors++ }) }
+
+func (s *runStats) urlWithoutMatches() { s.add(func(r *RunSummary) { r.URLsWithoutMatches++ }) }
+func (s *runStats) urlCapped()         { s.add(func(r *RunSummary) { r.URLsCapped++ }) }
+func (s *runStats) lookup()            { s.add(func(r *RunSummary) { r.Lookups++ }) }
+func (s *runStats) lookupOverBudget()  { s.add(func(r *RunSummary) { r.LookupsOverBudget++ }) }
+
+// observe records an IP and the CDN org it resolved to.
+func (s *runStats) observe(ip, cdnOrg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ips[ip] = struct{}{}
+	if cdnOrg != "" {
+		s.orgs[cdnOrg] = struct{}{}
+	}
+}
+
+// served records that account's hostname was seen on cdnOrg.
+func (s *runStats) served(account, hostname, cdnOrg string) {
+	if cdnOrg == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hostnames[account] == nil {
+		s.hostnames[account] = make(map[string]map[string]struct{})
+	}
+	if s.hostnames[account][cdnOrg] == nil {
+		s.hostnames[account][cdnOrg] = make(map[string]struct{})
+	}
+	s.hostnames[account][cdnOrg][hostname] = struct{}{}
+}
+
+func (s *runStats) snapshot() RunSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.summary
+	r.DurationSeconds = time.Since(r.StartedAt).Seconds()
+	r.UniqueIPs = len(s.ips)
+	r.UniqueCdnOrgs = len(s.orgs)
+	r.CDNDistribution = s.distribution()
+	return r
+}
+
+// distribution groups the hostnames seen by account and CDN org, sorted by
+// account and then by descending share. s.mu must be held.
+func (s *runStats) distribution() []CDNShare {
+	var out []CDNShare
+	for _, account := range slices.Sorted(maps.Keys(s.hostnames)) {
+		all := make(map[string]struct{})
+		for _, hosts := range s.hostnames[account] {
+			maps.Copy(all, hosts)
+		}
+
+		start := len(out)
+		for org, hosts := range s.hostnames[account] {
+			out = append(out, CDNShare{
+				Account:   account,
+				CdnOrg:    org,
+				Hostnames: len(hosts),
+				Percent:   100 * float64(len(hosts)) / float64(len(all)),
+			})
+		}
+		slices.SortFunc(out[start:], func(a, b CDNShare) int {
+			return cmp.Or(cmp.Compare(b.Hostnames, a.Hostnames), cmp.Compare(a.CdnOrg, b.CdnOrg))
+		})
+	}
+	return out
+}
+
+func printSummary(w io.Writer, r RunSummary) {
+	fmt.Fprintf(w, "Run summary (%s)\n", time.Duration(r.DurationSeconds*float64(time.Second)).Round(time.Millisecond))
+	fmt.Fprintf(w, "  URLs visited:      %d\n", r.URLsVisited)
+	fmt.Fprintf(w, "  Requests matched:  %d\n", r.RequestsMatched)
+	fmt.Fprintf(w, "  URLs w/o matches:  %d\n", r.URLsWithoutMatches)
+	if r.URLsCapped > 0 {
+		fmt.Fprintf(w, "  URLs capped:       %d\n", r.URLsCapped)
+	}
+	fmt.Fprintf(w, "  Unique IPs:        %d\n", r.UniqueIPs)
+	fmt.Fprintf(w, "  Unique CDN orgs:   %d\n", r.UniqueCdnOrgs)
+	fmt.Fprintf(w, "  Cache hits/misses: %d/%d\n", r.CacheHits, r.CacheMisses)
+	fmt.Fprintf(w, "  Lookups:           %d (%d over budget, ~%d estimated)\n", r.Lookups, r.LookupsOverBudget, r.EstimatedLookups)
+	fmt.Fprintf(w, "  Lookups avoided:   %d (cache hits)\n", r.CacheHits)
+	if r.LookupCost > 0 {
+		fmt.Fprintf(w, "  Lookup cost:       %.2f\n", r.LookupCost)
+	}
+	fmt.Fprintf(w, "  DB rows written:   %d\n", r.RowsWritten)
+	fmt.Fprintf(w, "  Errors:            %d\n", r.Errors)
+	for _, token := range slices.Sorted(maps.Keys(r.IPInfoTokenUsage)) {
+		fmt.Fprintf(w, "  ipinfo token %s: %d lookups\n", token, r.IPInfoTokenUsage[token])
+	}
+	if len(r.CDNDistribution) > 0 {
+		fmt.Fprintf(w, "CDN distribution (share of hostnames)\n")
+	}
+	for _, d := range r.CDNDistribution {
+		fmt.Fprintf(w, "  %s: %s %d (%.1f%%)\n", d.Account, d.CdnOrg, d.Hostnames, d.Percent)
+	}
+}
+
+// writeDistribution writes the CDN distribution of r to path, as CSV if
+// the name ends in .csv and as JSON otherwise.
+func writeDistribution(path string, r RunSummary) error {
+	if !strings.HasSuffix(path, ".csv") {
+		shares := r.CDNDistribution
+		if shares == nil {
+			shares = []CDNShare{}
+		}
+		b, err := json.MarshalIndent(shares, "", "  ")
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(path, append(b, '\n'), 0666)
+	}
+
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	cw.Write([]string{"account", "cdn_orgname", "hostnames", "percent"})
+	for _, d := range r.CDNDistribution {
+		cw.Write([]string{d.Account, d.CdnOrg, strconv.Itoa(d.Hostnames), strconv.FormatFloat(d.Percent, 'f', 1, 64)})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0666)
+}
+
+func writeSummaryJSON(path string, r RunSummary) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0666)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tlsCert is what we keep from an edge's certificate.
+type tlsCert struct {
+	Issuer string
+	SANs   []string
+}
+
+var tlsSANSuffixCDNs = []suffixMapping{
+	{Suffix: ".cloudfront.net", CDN: "Amazon, Inc."},
+	{Suffix: ".akamaized.net", CDN: "Akamai, Inc."},
+	{Suffix: ".akamaihd.net", CDN: "Akamai, Inc."},
+	{Suffix: ".fastly.net", CDN: "Fastly, Inc."},
+	{Suffix: ".fastlylb.net", CDN: "Fastly, Inc."},
+	{Suffix: ".edgecastcdn.net", CDN: "Edgecast Inc."},
+	{Suffix: ".llnwd.net", CDN: "Limelight Networks, Inc."},
+	{Suffix: ".hwcdn.net", CDN: "StackPath LLC."},
+}
+
+var tlsIssuerCDNs = []headerMapping{
+	{Contains: "cloudflare", CDN: "Cloudflare, Inc."},
+	{Contains: "akamai", CDN: "Akamai, Inc."},
+}
+
+// tlsCache memoizes handshakes per IP and server name for the process.
+var tlsCache sync.Map
+
+// fetchTLSCert performs a TLS handshake with ip, using the original hostname
+// for SNI, and returns the leaf certificate's issuer and SANs. It returns
+// false if the handshake fails.
+func fetchTLSCert(ip, hostname string) (tlsCert, bool) {
+	host, port, err := net.SplitHostPort(hostname)
+	if err != nil {
+		host, port = hostname, "443"
+	}
+
+	key := ip + "|" + host
+	if v, ok := tlsCache.Load(key); ok {
+		cert, _ := v.(*tlsCert)
+		return derefCert(cert)
+	}
+
+	dialer := &net.Dialer{Timeout: 3 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(ip, port), &tls.Config{
+		ServerName: host,
+		// Only the certificate's names are inspected; the connection is
+		// never used to send data.
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		tlsCache.Store(key, (*tlsCert)(nil))
+		return tlsCert{}, false
+	}
+	defer conn.Close()
+
+	var cert *tlsCert
+	if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		cert = &tlsCert{Issuer: certs[0].Issuer.CommonName, SANs: certs[0].DNSNames}
+	}
+	tlsCache.Store(key, cert)
+	return derefCert(cert)
+}
+
+func derefCert(cert *tlsCert) (tlsCert, bool) {
+	if cert == nil {
+		return tlsCert{}, false
+	}
+	return *cert, true
+}
+
+// tlsSignals maps a certificate's issuer and SANs to CDN signals.
+func tlsSignals(cert tlsCert) []Signal {
+	var signals []Signal
+
+	issuer := strings.ToLower(cert.Issuer)
+	for _, m := range tlsIssuerCDNs {
+		if strings.Contains(issuer, m.Contains) {
+			signals = append(signals, Signal{Source: "tls_issuer", Value: cert.Issuer, CDN: m.CDN})
+			break
+		}
+	}
+
+	for _, san := range cert.SANs {
+		if cdn := matchSuffix(strings.TrimPrefix(san, "*"), tlsSANSuffixCDNs); cdn != "" {
+			signals = append(signals, Signal{Source: "tls_san", Value: san, CDN: cdn})
+			break
+		}
+	}
+	return signals
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"time"
+
+	"github.com/chromedp/cdproto/cdp"
+)
+
+// markNavigation records when the page's main document was requested. Only
+// the first document request counts, so iframes don't reset it.
+func (c *capture) markNavigation(ts *cdp.MonotonicTime) {
+	if ts == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.navStart.IsZero() {
+		c.navStart = ts.Time()
+	}
+}
+
+// markFirstSegment records the delay between navigation and the first
+// request matching the media filters. Both times come from the browser's
+// monotonic clock, so event delivery latency doesn't skew it.
+func (c *capture) markFirstSegment(ts *cdp.MonotonicTime) {
+	if ts == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.navStart.IsZero() || c.firstSegment != 0 {
+		return
+	}
+	c.firstSegment = max(ts.Time().Sub(c.navStart), time.Nanosecond)
+}
+
+// timeToFirstSegment returns the time to first segment until it has been
+// reported with firstSegmentReported, so it is stored on one row only.
+func (c *capture) timeToFirstSegment() (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.firstSegment, c.firstSegment != 0 && !c.firstSegmentSent
+}
+
+func (c *capture) firstSegmentReported() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.firstSegmentSent = true
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+)
+
+// StreamURL is a URL to collect and the stream type it is recorded under.
+type StreamURL struct {
+	StreamType string `json:"streamType"`
+	URL        string `json:"url"`
+}
+
+// StreamURLs is an ordered list of URLs. Several URLs may share a stream
+// type, and they are collected in the order given.
+type StreamURLs []StreamURL
+
+// UnmarshalJSON accepts a list of {"streamType", "url"} objects, or the
+// older {"live": url, "ondemand": url} object form. Keys of the object form
+// are kept in document order, including repeated keys.
+func (u *StreamURLs) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 || b[0] != '{' {
+		return json.Unmarshal(b, (*[]StreamURL)(u))
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+
+	urls := StreamURLs{}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		var url string
+		if err := dec.Decode(&url); err != nil {
+			return fmt.Errorf("urls.%s: %w", key, err)
+		}
+		urls = append(urls, StreamURL{StreamType: key.(string), URL: url})
+	}
+
+	*u = urls
+	return nil
+}
+
+// streamURLs returns the account's inline URLs followed by any loaded from
+// URLsFile.
+func (a Account) streamURLs() []StreamURL {
+	urls := make([]StreamURL, 0, len(a.URLs)+len(a.fileURLs))
+	urls = append(urls, a.URLs...)
+	return append(urls, a.fileURLs...)
+}
+
+// loadURLsFiles reads the URLsFile of every account. At most one account
+// may read from stdin with "-".
+func loadURLsFiles(accounts []Account) error {
+	stdinUsed := false
+	for i := range accounts {
+		a := &accounts[i]
+		if a.URLsFile == "" {
+			continue
+		}
+
+		if a.URLsFile == "-" {
+			if stdinUsed {
+				return errors.New("only one account can read URLs from stdin")
+			}
+			stdinUsed = true
+		}
+
+		urls, err := readURLsFile(a.URLsFile)
+		if err != nil {
+			return err
+		}
+		a.fileURLs = urls
+	}
+	return nil
+}
+
+func readURLsFile(name string) ([]StreamURL, error) {
+	if name == "-" {
+		return parseURLsFile("stdin", os.Stdin)
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseURLsFile(name, f)
+}
+
+// parseURLsFile reads one "streamType,url" pair per line. Blank lines and
+// lines starting with # are ignored.
+func parseURLsFile(name string, r io.Reader) ([]StreamURL, error) {
+	var urls []StreamURL
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		streamType, url, ok := strings.Cut(text, ",")
+		streamType, url = strings.TrimSpace(streamType), strings.TrimSpace(url)
+		if !ok || streamType == "" || url == "" {
+			return nil, fmt.Errorf("%s:%d: expected streamType,url", name, line)
+		}
+		urls = append(urls, StreamURL{StreamType: streamType, URL: url})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return urls, nil
+}
+
+// normalizeURL removes the query parameters named in strip from raw, so
+// per-session tokens don't make the same segment look like a new URL. A
+// strip entry of "*" removes the whole query. The host is left untouched.
+func normalizeURL(raw string, strip []string) string {
+	if len(strip) == 0 {
+		return raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+
+	if slices.Contains(strip, "*") {
+		u.RawQuery = ""
+	} else {
+		q := u.Query()
+		for _, p := range strip {
+			q.Del(p)
+		}
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"time"
+)
+
+// checkResult is the outcome of one preflight check of the validate
+// subcommand.
+type checkResult struct {
+	Name string
+	Err  error
+}
+
+// runValidate implements the validate subcommand: a preflight that loads
+// the config, pings the database and tries each lookup provider once,
+// without collecting anything.
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	ip := fs.String("ip", "8.8.8.8", "IP to test the lookup providers with")
+	resolveURLs := fs.Bool("resolve", false, "also resolve the hostname of every account URL")
+	fs.StringVar(&cacheFlag, "cache", "", "use this cache file, overriding cache.file and cache.namespace")
+	fs.Parse(args)
+
+	err := setup()
+	if err != nil {
+		printChecks(os.Stdout, []checkResult{{"config", err}})
+		return exitConfigError
+	}
+	testIP := net.ParseIP(*ip)
+	if testIP == nil {
+		slog.Error("Invalid -ip", "ip", *ip)
+		return exitConfigError
+	}
+
+	checks := []checkResult{{"config", nil}}
+	checks = append(checks, checkResult{"urls files", loadURLsFiles(config.Accounts)})
+
+	if slices.ContainsFunc(config.Outputs, func(o OutputConfig) bool { return o.Type == "" || o.Type == "db" }) {
+		checks = append(checks, checkResult{"database", pingDB()})
+	}
+
+	// The collector installs the lookup cache, limiter and tokens, but the
+	// cache is not saved, so test lookups leave no trace.
+	_, err = NewCollector(config, new(memorySink))
+	checks = append(checks, checkResult{"lookup cache", err})
+	if err == nil {
+		for _, provider := range config.Lookup.Providers {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			_, err := lookupProviders[provider](ctx, "", testIP)
+			cancel()
+			checks = append(checks, checkResult{"lookup " + provider, err})
+		}
+	}
+
+	if *resolveURLs {
+		seen := make(map[string]bool)
+		for _, a := range config.Accounts {
+			for _, u := range a.streamURLs() {
+				host := hostOf(u.URL)
+				if seen[host] {
+					continue
+				}
+				seen[host] = true
+				_, _, err := resolve(u.URL)
+				checks = append(checks, checkResult{"resolve " + host, err})
+			}
+		}
+	}
+
+	printChecks(os.Stdout, checks)
+	if slices.ContainsFunc(checks, func(c checkResult) bool { return c.Err != nil }) {
+		return exitTotalFailure
+	}
+	return exitOK
+}
+
+// pingDB opens the database and checks that it answers.
+func pingDB() error {
+	if err := openDB(); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return db.PingContext(ctx)
+}
+
+func printChecks(w io.Writer, checks []checkResult) {
+	for _, c := range checks {
+		if c.Err != nil {
+			fmt.Fprintf(w, "FAIL  %s: %v\n", c.Name, c.Err)
+		} else {
+			fmt.Fprintf(w, "PASS  %s\n", c.Name)
+		}
+	}
+}
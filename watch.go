@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// reloadedConfig is the part of a re-read config that watch mode applies
+// to later runs. Other settings keep their startup values until restart.
+type reloadedConfig struct {
+	accounts []Account
+	rules    []fingerprintRule
+	orgNames OrgNamesConfig
+}
+
+// configWatcher reloads the config file when it is modified or the process
+// receives SIGHUP. A reload is validated as soon as it happens and applied
+// between runs, so a run never sees a mix of old and new accounts.
+type configWatcher struct {
+	path             string
+	include, exclude []string
+
+	mu      sync.Mutex
+	modTime time.Time
+	pending atomic.Pointer[reloadedConfig]
+}
+
+func newConfigWatcher(path string, include, exclude []string) (*configWatcher, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &configWatcher{path: path, include: include, exclude: exclude, modTime: fi.ModTime()}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			slog.Info("Received SIGHUP, reloading config", "path", path)
+			w.reload()
+		}
+	}()
+	return w, nil
+}
+
+// reload re-reads and validates the config file and, if it is valid, queues
+// it for the next run. An invalid config is logged and the current one kept.
+func (w *configWatcher) reload() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if fi, err := os.Stat(w.path); err == nil {
+		w.modTime = fi.ModTime()
+	}
+
+	r, err := loadReloadedConfig(w.path, w.include, w.exclude)
+	if err != nil {
+		slog.Error("Config reload failed, keeping the previous config", "path", w.path, "error", err)
+		return
+	}
+	w.pending.Store(r)
+	slog.Info("Config reloaded, applying from the next run", "path", w.path, "accounts", len(r.accounts))
+}
+
+// apply reloads the config if the file changed since it was last read, then
+// swaps in any pending reload. It must only be called between runs.
+func (w *configWatcher) apply() {
+	w.mu.Lock()
+	fi, err := os.Stat(w.path)
+	changed := err == nil && !fi.ModTime().Equal(w.modTime)
+	w.mu.Unlock()
+	if changed {
+		w.reload()
+	}
+
+	if r := w.pending.Swap(nil); r != nil {
+		config.Accounts = r.accounts
+		fingerprints.Store(&r.rules)
+		orgNames.Store(&r.orgNames)
+	}
+}
+
+func loadReloadedConfig(path string, include, exclude []string) (*reloadedConfig, error) {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	accounts := filterAccounts(cfg.Accounts, include, exclude)
+	for _, a := range accounts {
+		if a.URLsFile == "-" {
+			return nil, errors.New("urlsFile \"-\" cannot be reloaded from stdin")
+		}
+	}
+	if err := loadURLsFiles(accounts); err != nil {
+		return nil, err
+	}
+	if err := loadCookiesFiles(accounts); err != nil {
+		return nil, err
+	}
+
+	rules, err := compileFingerprintRules(cfg.Detection.Rules)
+	if err != nil {
+		return nil, err
+	}
+	return &reloadedConfig{accounts: accounts, rules: rules, orgNames: cfg.OrgNames}, nil
+}
+
+// stopSignals returns a channel that receives SIGINT and SIGTERM, so watch
+// mode can finish the current run and close its outputs before exiting.
+func stopSignals() <-chan os.Signal {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	return stop
+}